@@ -0,0 +1,135 @@
+package downloader
+
+import (
+	"errors"
+	"fmt"
+	"io"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+)
+
+// byteRangesBoundary returns the boundary of a multipart/byteranges response, which some servers send even for
+// a single range, with the Content-Range of every part in its own headers instead of the response's
+func byteRangesBoundary(header http.Header) (string, bool) {
+	mediaType, params, err := mime.ParseMediaType(header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/byteranges" || params["boundary"] == "" {
+		return "", false
+	}
+	return params["boundary"], true
+}
+
+// firstPartHeader returns the headers of the first part of a multipart/byteranges body, its Content-Range
+// and the Content-Type of the file
+func firstPartHeader(body io.Reader, boundary string) (textproto.MIMEHeader, error) {
+	part, err := multipart.NewReader(body, boundary).NextPart()
+	if err != nil {
+		return nil, fmt.Errorf("Server Error: invalid multipart/byteranges response: %w", err)
+	}
+	return part.Header, nil
+}
+
+// byteRangesReader reads the payload of the parts of a multipart/byteranges response for the bytes start to end,
+// without the boundaries and part headers, and tells the offset in the file every read belongs at
+// The parts may come in any order, but every part must hold exactly the bytes of its Content-Range, of a file
+// of fileSize bytes, within start to end and without overlapping another part, and together they must cover start to end
+type byteRangesReader struct {
+	parts *multipart.Reader
+	part  *multipart.Part
+	// next is the offset of the next byte of part, which ends at partEnd
+	next     int64
+	partEnd  int64
+	start    int64
+	end      int64
+	fileSize int64
+	// ranges are the first and last bytes of the parts started so far
+	ranges [][2]int64
+	// written are the ranges of bytes written so far, as reported by wrote
+	written [][2]int64
+}
+
+// newByteRangesReader returns a reader of the bytes start to end from the multipart/byteranges body
+func newByteRangesReader(body io.Reader, boundary string, start int64, end int64, fileSize int64) *byteRangesReader {
+	return &byteRangesReader{parts: multipart.NewReader(body, boundary), start: start, end: end, fileSize: fileSize}
+}
+
+// read reads the next bytes of the current part into p and returns the offset of the first of them,
+// it returns io.EOF once the parts cover start to end
+func (r *byteRangesReader) read(p []byte) (int, int64, error) {
+	for {
+		if r.part == nil {
+			var covered int64
+			for _, byteRange := range r.ranges {
+				covered += byteRange[1] - byteRange[0] + 1
+			}
+			if covered == r.end-r.start+1 {
+				return 0, r.end + 1, io.EOF
+			}
+			part, err := r.parts.NextPart()
+			if errors.Is(err, io.EOF) {
+				return 0, 0, fmt.Errorf("Server Error: the parts of the multipart/byteranges response hold %d of the %d requested bytes", covered, r.end-r.start+1)
+			}
+			if err != nil {
+				return 0, 0, fmt.Errorf("Server Error: invalid multipart/byteranges response: %w", err)
+			}
+			first, last, total, err := parseContentRange(part.Header.Get("Content-Range"))
+			if err != nil {
+				return 0, 0, err
+			}
+			if first < r.start || last < first || last > r.end {
+				return 0, 0, fmt.Errorf("Server Error: expected a part within bytes %d-%d but got %d-%d", r.start, r.end, first, last)
+			}
+			for _, byteRange := range r.ranges {
+				if first <= byteRange[1] && byteRange[0] <= last {
+					return 0, 0, fmt.Errorf("Server Error: the part for bytes %d-%d overlaps the one for bytes %d-%d", first, last, byteRange[0], byteRange[1])
+				}
+			}
+			if err := checkTotal(total, r.fileSize); err != nil {
+				return 0, 0, err
+			}
+			r.part, r.next, r.partEnd = part, first, last
+			r.ranges = append(r.ranges, [2]int64{first, last})
+		}
+		offset := r.next
+		n, err := r.part.Read(p)
+		r.next += int64(n)
+		if r.next > r.partEnd+1 {
+			return 0, offset, fmt.Errorf("Server Error: a part of the multipart/byteranges response goes past byte %d of its Content-Range", r.partEnd)
+		}
+		if err == io.EOF {
+			if r.next != r.partEnd+1 {
+				return n, offset, fmt.Errorf("Server Error: a part of the multipart/byteranges response ended at byte %d instead of %d", r.next-1, r.partEnd)
+			}
+			r.part = nil
+			if n == 0 {
+				continue
+			}
+			return n, offset, nil
+		}
+		return n, offset, err
+	}
+}
+
+// wrote records that the n bytes at offset have been written
+func (r *byteRangesReader) wrote(offset int64, n int64) {
+	if last := len(r.written) - 1; last >= 0 && r.written[last][1]+1 == offset {
+		r.written[last][1] += n
+	} else if n > 0 {
+		r.written = append(r.written, [2]int64{offset, offset + n - 1})
+	}
+}
+
+// completed returns the offset up to which all bytes from start have been written
+func (r *byteRangesReader) completed() int64 {
+	offset := r.start
+	for found := true; found; {
+		found = false
+		for _, byteRange := range r.written {
+			if byteRange[0] == offset {
+				offset, found = byteRange[1]+1, true
+			}
+		}
+	}
+	return offset
+}
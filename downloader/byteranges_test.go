@@ -0,0 +1,172 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+)
+
+// halves splits the bytes first to last into two parts, or one if there is a single byte
+func halves(first int, last int) [][2]int {
+	middle := first + (last-first+1)/2
+	if middle == first {
+		return [][2]int{{first, last}}
+	}
+	return [][2]int{{first, middle - 1}, {middle, last}}
+}
+
+// serveByteRanges answers every Range request for bytes first-last of content with a multipart/byteranges
+// response holding the parts returned by layout for them
+func serveByteRanges(content []byte, layout func(first int, last int) [][2]int) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		var first, last int
+		if _, err := fmt.Sscanf(r.Header.Get("Range"), "bytes=%d-%d", &first, &last); err != nil {
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+			if r.Method != http.MethodHead {
+				w.Write(content)
+			}
+			return
+		}
+		var body bytes.Buffer
+		writer := multipart.NewWriter(&body)
+		for _, part := range layout(first, min(last, len(content)-1)) {
+			partWriter, _ := writer.CreatePart(map[string][]string{
+				"Content-Type":  {"application/octet-stream"},
+				"Content-Range": {fmt.Sprintf("bytes %d-%d/%d", part[0], part[1], len(content))},
+			})
+			partWriter.Write(content[part[0] : part[1]+1])
+		}
+		writer.Close()
+		w.Header().Set("Content-Type", "multipart/byteranges; boundary="+writer.Boundary())
+		w.Header().Set("Content-Length", strconv.Itoa(body.Len()))
+		w.WriteHeader(http.StatusPartialContent)
+		w.Write(body.Bytes())
+	}
+}
+
+// TestByteRanges checks that the chunks of a server answering with multipart/byteranges responses get only
+// the payload of the parts, none of the boundaries or part headers
+func TestByteRanges(t *testing.T) {
+	content := testContent(100000)
+	result, got := downloadFrom(t, serveByteRanges(content, halves), Downloader{Chunks: 4})
+	if !bytes.Equal(got, content) {
+		t.Fatal("downloaded file does not match the content")
+	}
+	if result.Chunks != 4 {
+		t.Fatalf("got %d chunks, want 4", result.Chunks)
+	}
+}
+
+// TestByteRangesOutOfOrder checks that the parts of multipart/byteranges responses that come out of order
+// are each written at the offset of their Content-Range
+func TestByteRangesOutOfOrder(t *testing.T) {
+	content := testContent(100000)
+	tests := []struct {
+		name   string
+		layout func(first int, last int) [][2]int
+	}{
+		{"reversed", func(first int, last int) [][2]int {
+			parts := halves(first, last)
+			for i, j := 0, len(parts)-1; i < j; i, j = i+1, j-1 {
+				parts[i], parts[j] = parts[j], parts[i]
+			}
+			return parts
+		}},
+		{"first part last", func(first int, last int) [][2]int {
+			third := (last - first + 1) / 3
+			return [][2]int{{first + third, first + 2*third - 1}, {first + 2*third, last}, {first, first + third - 1}}
+		}},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, got := downloadFrom(t, serveByteRanges(content, test.layout), Downloader{Chunks: 4})
+			if !bytes.Equal(got, content) {
+				t.Fatal("downloaded file does not match the content")
+			}
+			if result.Chunks != 4 || result.Bytes != int64(len(content)) {
+				t.Fatalf("got %d bytes in %d chunks, want %d in 4", result.Bytes, result.Chunks, len(content))
+			}
+		})
+	}
+}
+
+// TestByteRangesInvalid checks that multipart/byteranges responses whose parts overlap or leave out some of the
+// requested bytes fail the chunks
+func TestByteRangesInvalid(t *testing.T) {
+	content := testContent(100000)
+	tests := []struct {
+		name   string
+		layout func(first int, last int) [][2]int
+		err    string
+	}{
+		{"overlapping parts", func(first int, last int) [][2]int {
+			return [][2]int{{first + 10, last}, {first, first + 10}}
+		}, "overlaps"},
+		{"missing bytes", func(first int, last int) [][2]int {
+			return [][2]int{{first + 10, last}}
+		}, "hold"},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(serveByteRanges(content, test.layout))
+			defer server.Close()
+
+			output := filepath.Join(t.TempDir(), "file.bin")
+			d := Downloader{URL: server.URL + "/file.bin", Client: server.Client(), OutputPath: output, Chunks: 4, Retries: 1}
+			_, err := d.Download(context.Background())
+			var chunksErr *ChunksError
+			if !errors.As(err, &chunksErr) || len(chunksErr.Failed) != 4 {
+				t.Fatalf("got %v, want all 4 chunks to fail", err)
+			}
+			for _, failed := range chunksErr.Failed {
+				if !strings.Contains(failed.Err.Error(), test.err) {
+					t.Errorf("chunk %d failed with %v, want an error about %s", failed.Chunk, failed.Err, test.name)
+				}
+			}
+			if _, err := os.Stat(output); !os.IsNotExist(err) {
+				t.Fatalf("output file was created: %v", err)
+			}
+		})
+	}
+}
+
+// TestWriteChunksByteRangesOutOfOrderFailure checks that a chunk whose parts come out of order and fail part way
+// returns the offset up to which all its bytes have been written, and counts only those as downloaded
+func TestWriteChunksByteRangesOutOfOrderFailure(t *testing.T) {
+	content := testContent(1000)
+	var body bytes.Buffer
+	writer := multipart.NewWriter(&body)
+	for _, part := range [][2]int{{0, 299}, {600, 999}, {300, 599}} {
+		partWriter, _ := writer.CreatePart(map[string][]string{"Content-Range": {fmt.Sprintf("bytes %d-%d/1000", part[0], part[1])}})
+		partWriter.Write(content[part[0] : part[1]+1])
+	}
+	writer.Close()
+	// The connection is lost in the middle of the last part
+	cut := bytes.Index(body.Bytes(), content[300:600]) + 100
+	response := rangeResponse(bytes.NewReader(body.Bytes()[:cut]), 0, 999, 1000)
+	response.Header.Set("Content-Type", "multipart/byteranges; boundary="+writer.Boundary())
+
+	d := testDownloader(t, Downloader{})
+	file := make(writerAt, len(content))
+	var downloaded int64
+	offset, err := d.writeChunks(context.Background(), response, file, 0, 0, 999, 1000, &downloaded, nil)
+	if err == nil {
+		t.Fatal("writeChunks succeeded with the last part cut short")
+	}
+	if offset != 400 || downloaded != 400 {
+		t.Fatalf("chunk ended at offset %d with %d bytes downloaded, want 400 and 400", offset, downloaded)
+	}
+	if !bytes.Equal(file[:400], content[:400]) || !bytes.Equal(file[600:], content[600:]) {
+		t.Fatal("written bytes do not match the content")
+	}
+}
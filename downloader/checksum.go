@@ -0,0 +1,103 @@
+package downloader
+
+import (
+	"crypto/md5"
+	"crypto/sha1"
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"os"
+	"strings"
+)
+
+// DefaultHash is the checksum algorithm used when Downloader.Hashes is not set
+const DefaultHash = "sha256"
+
+// newHash returns a new hash.Hash for the named algorithm: md5, sha1, sha256, sha512 or crc32
+// crc32 is the Castagnoli CRC, a cheap check against corruption rather than tampering, hardware-accelerated on most CPUs
+func newHash(algorithm string) (hash.Hash, error) {
+	switch algorithm {
+	case "md5":
+		return md5.New(), nil
+	case "sha1":
+		return sha1.New(), nil
+	case "sha256":
+		return sha256.New(), nil
+	case "sha512":
+		return sha512.New(), nil
+	case "crc32":
+		return crc32.New(crc32.MakeTable(crc32.Castagnoli)), nil
+	}
+	return nil, fmt.Errorf("unsupported checksum algorithm %q, expected md5, sha1, sha256, sha512 or crc32", algorithm)
+}
+
+// ChecksumError is returned by Download when the file does not match one of Downloader.Expected
+type ChecksumError struct {
+	Algorithm string
+	Expected  string
+	Actual    string
+}
+
+func (e *ChecksumError) Error() string {
+	return "CHECKSUM MISMATCH: expected " + strings.ToUpper(e.Algorithm) + " " + e.Expected + " but got " + e.Actual
+}
+
+// newHashes returns a hash for every algorithm, and a writer that feeds all of them at once
+func newHashes(algorithms []string) (map[string]hash.Hash, io.Writer, error) {
+	hashes := make(map[string]hash.Hash, len(algorithms))
+	writers := make([]io.Writer, 0, len(algorithms))
+	for _, algorithm := range algorithms {
+		h, err := newHash(algorithm)
+		if err != nil {
+			return nil, nil, err
+		}
+		hashes[algorithm] = h
+		writers = append(writers, h)
+	}
+	return hashes, io.MultiWriter(writers...), nil
+}
+
+// sums returns the checksum of every hash by algorithm
+func sums(hashes map[string]hash.Hash) map[string][]byte {
+	checksums := make(map[string][]byte, len(hashes))
+	for algorithm, h := range hashes {
+		checksums[algorithm] = h.Sum(nil)
+	}
+	return checksums
+}
+
+// calculateChecksums returns the checksums of the file at filePath for every algorithm, reading it only once
+func calculateChecksums(filePath string, algorithms []string) (map[string][]byte, error) {
+	writtenFile, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer writtenFile.Close()
+	return hashReader(writtenFile, algorithms)
+}
+
+// hashReader returns the checksums of everything read from r for the given algorithms
+func hashReader(r io.Reader, algorithms []string) (map[string][]byte, error) {
+	hashes, w, err := newHashes(algorithms)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		return nil, err
+	}
+	return sums(hashes), nil
+}
+
+// verifyChecksums compares the checksums to the expected hex encoded ones, case-insensitively
+func verifyChecksums(checksums map[string][]byte, expected map[string]string) error {
+	for algorithm, want := range expected {
+		if got := hex.EncodeToString(checksums[algorithm]); !strings.EqualFold(got, want) {
+			return &ChecksumError{Algorithm: algorithm, Expected: strings.ToLower(want), Actual: got}
+		}
+	}
+	return nil
+}
@@ -0,0 +1,868 @@
+package downloader
+
+import (
+	"bufio"
+	"compress/flate"
+	"compress/gzip"
+	"compress/zlib"
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// StatusError is returned when the server answers a request for the file with an unexpected HTTP status,
+// by a chunk request if it is not 206 Partial Content, or by a single stream download if it is not 200 OK
+type StatusError struct {
+	// StatusCode and Status are those of the response, e.g. 404 and "404 Not Found"
+	StatusCode int
+	Status     string
+	retryAfter string
+}
+
+// ErrUpstreamChanged is returned for chunks requested after the file changed upstream,
+// as detected by the If-Range header with the ETag or Last-Modified date reported by the support check
+var ErrUpstreamChanged = errors.New("upstream file changed during download")
+
+// ErrSizeMismatch is returned for a chunk whose Content-Range header holds another total than the file size
+// reported by the support check, e.g. by a broken proxy, or because the file changed upstream
+// All chunks are stopped then, as the file could only be assembled truncated or padded
+var ErrSizeMismatch = errors.New("Content-Range total does not match the file size")
+
+// rangeNotSatisfiableError is returned by getObjectRange for a 416 Range Not Satisfiable response, which a server
+// sends for a range past the end of the file, e.g. once the file got shorter upstream
+type rangeNotSatisfiableError struct {
+	dwLink string
+	// size is the file size from the "bytes */<size>" Content-Range header of the response, -1 if it sent none
+	size int64
+}
+
+func (e *rangeNotSatisfiableError) Error() string {
+	return "server responded with 416 Range Not Satisfiable"
+}
+
+func (e *StatusError) Error() string {
+	if e.StatusCode == http.StatusOK {
+		return "server ignored the Range header and responded with " + e.Status + " instead of 206 Partial Content"
+	}
+	return "server responded with " + e.Status
+}
+
+// getObjectRange obtains the range of bytes from rangeStart to rangeEnd from the server using the Range HTTP request header
+// returns the HTTP response, or a *StatusError if the response is not 206 Partial Content,
+// a *rangeNotSatisfiableError for 416 Range Not Satisfiable
+// Anything else, including a 200 OK with the full file, would corrupt the file when written at the chunk's offset
+func (d *Downloader) getObjectRange(ctx context.Context, dwLink string, rangeStart int64, rangeEnd int64) (http.Response, error) {
+	craftRequest, err := d.newRequest(ctx, "GET", dwLink)
+	if err != nil {
+		return http.Response{}, err
+	}
+	craftRequest.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", rangeStart, rangeEnd))
+	// With If-Range, a server that has a different version of the file answers with the whole new file instead
+	validator := d.validators[dwLink]
+	if validator != "" {
+		craftRequest.Header.Set("If-Range", validator)
+	}
+	response, err := d.Client.Do(craftRequest)
+	if err != nil {
+		d.debugf("GET %s bytes=%d-%d failed: %s", dwLink, rangeStart, rangeEnd, err)
+		return http.Response{}, err
+	}
+	d.debugf("GET %s bytes=%d-%d: %s %s", dwLink, rangeStart, rangeEnd, response.Proto, response.Status)
+	if response.StatusCode == http.StatusOK && validator != "" && getValidator(response.Header) != validator {
+		response.Body.Close()
+		return http.Response{}, ErrUpstreamChanged
+	}
+	if response.StatusCode == http.StatusRequestedRangeNotSatisfiable {
+		response.Body.Close()
+		size, err := parseContentRangeTotal(response.Header.Get("Content-Range"))
+		if err != nil {
+			size = -1
+		}
+		return http.Response{}, &rangeNotSatisfiableError{dwLink: dwLink, size: size}
+	}
+	if response.StatusCode != http.StatusPartialContent {
+		response.Body.Close()
+		return http.Response{}, &StatusError{
+			StatusCode: response.StatusCode,
+			Status:     response.Status,
+			retryAfter: response.Header.Get("Retry-After"),
+		}
+	}
+	return *response, err
+}
+
+// checkSizeAfterRangeError returns the error for the chunk from rangeStart to rangeEnd answered with rangeErr:
+// the current size of the file is taken from the response, or else probed again, and if the file is no longer
+// fileSize bytes, which is the usual cause, the error wraps ErrSizeMismatch so that all chunks are stopped
+// The chunks are not planned again for the new size, as the bytes downloaded so far may be from another version
+func (d *Downloader) checkSizeAfterRangeError(ctx context.Context, rangeErr *rangeNotSatisfiableError, rangeStart int64, rangeEnd int64, fileSize int64) error {
+	size := rangeErr.size
+	if size == -1 {
+		remote, err := d.confirmSupport(ctx, rangeErr.dwLink, false)
+		if err != nil {
+			return fmt.Errorf("Server Error: bytes %d-%d of the %d byte file are not satisfiable, and checking its size again failed: %w", rangeStart, rangeEnd, fileSize, err)
+		}
+		if !remote.AcceptsRanges {
+			return fmt.Errorf("Server Error: bytes %d-%d of the %d byte file are not satisfiable, and the server no longer reports its size", rangeStart, rangeEnd, fileSize)
+		}
+		size = remote.Size
+	}
+	if size != fileSize {
+		return fmt.Errorf("Server Error: %w: bytes %d-%d are not satisfiable as the file is now %d bytes instead of %d, it changed upstream", ErrSizeMismatch, rangeStart, rangeEnd, size, fileSize)
+	}
+	return fmt.Errorf("Server Error: bytes %d-%d of the %d byte file were answered with 416 Range Not Satisfiable although its size did not change", rangeStart, rangeEnd, fileSize)
+}
+
+// retryBaseDelay is the delay before the first retry of a failed range request, it doubles with every further attempt
+const retryBaseDelay = 500 * time.Millisecond
+
+// isRetryableStatus reports whether an HTTP response status is worth retrying, i.e. one of d.RetryOn
+func (d *Downloader) isRetryableStatus(statusCode int) bool {
+	for _, status := range d.RetryOn {
+		if status == statusCode {
+			return true
+		}
+	}
+	return false
+}
+
+// retryDelay returns the exponential backoff delay with jitter for the given retry attempt (starting from 0)
+// A valid Retry-After header from the server takes precedence over the backoff
+func retryDelay(attempt int, retryAfter string) time.Duration {
+	if seconds, err := strconv.Atoi(retryAfter); err == nil && seconds >= 0 {
+		return time.Duration(seconds) * time.Second
+	}
+	if date, err := http.ParseTime(retryAfter); err == nil {
+		return time.Until(date)
+	}
+	delay := retryBaseDelay << uint(attempt)
+	// Add up to 50% jitter so that chunks failing together do not all retry at the same moment
+	return delay + time.Duration(rand.Int63n(int64(delay)/2+1))
+}
+
+// getObjectRangeWithRetry calls getObjectRange, retrying transport errors and retryable HTTP statuses up to d.Retries times
+// The range is requested from dwLinks round-robin, starting with dwLinks[source], so every retry goes to the next mirror
+// Returns the response and the index in dwLinks of the URL it came from
+// Waiting for the next retry is cut short when ctx is canceled
+func (d *Downloader) getObjectRangeWithRetry(ctx context.Context, dwLinks []string, source int, currChunk int64, rangeStart int64, rangeEnd int64) (http.Response, int, error) {
+	for attempt := 0; ; attempt++ {
+		dwLink := dwLinks[(source+attempt)%len(dwLinks)]
+		response, err := d.getObjectRange(ctx, dwLink, rangeStart, rangeEnd)
+		if err == nil {
+			return response, (source + attempt) % len(dwLinks), nil
+		}
+		var rangeErr *rangeNotSatisfiableError
+		if errors.Is(err, ErrUpstreamChanged) || errors.As(err, &rangeErr) {
+			return http.Response{}, 0, err
+		}
+		var retryAfter string
+		var statusErr *StatusError
+		if errors.As(err, &statusErr) {
+			if !d.isRetryableStatus(statusErr.StatusCode) {
+				return http.Response{}, 0, err
+			}
+			retryAfter = statusErr.retryAfter
+		}
+		if attempt >= d.Retries || ctx.Err() != nil {
+			return http.Response{}, 0, err
+		}
+		delay := retryDelay(attempt, retryAfter)
+		retryOn := ""
+		if len(dwLinks) > 1 {
+			retryOn = " on " + dwLinks[(source+attempt+1)%len(dwLinks)]
+		}
+		d.Metrics.ChunkRetried()
+		d.warnf("Retrying chunk %d%s in %s (retry %d of %d): %s", currChunk+1, retryOn, delay.Round(time.Millisecond), attempt+1, d.Retries, err.Error())
+		timer := time.NewTimer(delay)
+		select {
+		case <-ctx.Done():
+			timer.Stop()
+			return http.Response{}, 0, ctx.Err()
+		case <-timer.C:
+		}
+	}
+}
+
+// errStalled is returned by writeChunks and downloadWhole when no bytes arrived for Downloader.StallTimeout
+var errStalled error = stalledError{}
+
+// stalledError is the type of errStalled, a timeout like those of net.Error
+type stalledError struct{}
+
+func (stalledError) Error() string {
+	return "no bytes received"
+}
+
+// Timeout reports the stall as a timeout
+func (stalledError) Timeout() bool {
+	return true
+}
+
+// stallWatchdog closes a response body when a read from it takes longer than the stall timeout,
+// which unblocks the read, since a stalled connection may otherwise never return
+// A nil *stallWatchdog does nothing, for when there is no stall timeout
+type stallWatchdog struct {
+	timeout time.Duration
+	timer   *time.Timer
+	stalled int32
+}
+
+// watchStalls returns a watchdog closing body on stalls, or nil if d.StallTimeout is not set
+func (d *Downloader) watchStalls(body io.Closer) *stallWatchdog {
+	if d.StallTimeout <= 0 {
+		return nil
+	}
+	w := &stallWatchdog{timeout: d.StallTimeout}
+	w.timer = time.AfterFunc(d.StallTimeout, func() {
+		atomic.StoreInt32(&w.stalled, 1)
+		body.Close()
+	})
+	w.timer.Stop()
+	return w
+}
+
+// start is called before every read
+func (w *stallWatchdog) start() {
+	if w != nil {
+		w.timer.Reset(w.timeout)
+	}
+}
+
+// stop is called after every read, so that waiting for the rate limiter does not count as a stall
+func (w *stallWatchdog) stop() {
+	if w != nil {
+		w.timer.Stop()
+	}
+}
+
+// err returns errStalled if the watchdog closed the body
+func (w *stallWatchdog) err() error {
+	if w != nil && atomic.LoadInt32(&w.stalled) == 1 {
+		return fmt.Errorf("%w for %s", errStalled, w.timeout)
+	}
+	return nil
+}
+
+// writeChunks writes the obtained object to the right position in the file
+// The Content-Range of the response must be exactly rangeStart to rangeEnd of a file of fileSize bytes,
+// otherwise the bytes would be written at the wrong offset, or come from a file that changed upstream
+// A multipart/byteranges response is unwrapped, its parts are written at the offsets of their Content-Range
+// and must cover rangeStart to rangeEnd, in any order
+// Every write is also added to the downloaded counter shared with printProgress
+// and, if written is not nil, stored in it as the offset up to which the chunk has been written
+// On error, the returned offset is how far the chunk got, all bytes from rangeStart up to it have been written
+func (d *Downloader) writeChunks(ctx context.Context, response http.Response, fileToWrite io.WriterAt, currChunk int64, rangeStart int64, rangeEnd int64, fileSize int64, downloaded *int64, written *int64) (int64, error) {
+	var writeRangeStart = rangeStart
+	startTime := time.Now()
+	// Obtain size of response to compare the bytes read from the object
+	// A missing or invalid Content-Length leaves responseSize at 0, which is reported as a mismatch below
+	responseSize, _ := strconv.ParseInt(response.Header.Get("Content-Length"), 10, 64)
+
+	defer response.Body.Close()
+	var byteRanges *byteRangesReader
+	if boundary, ok := byteRangesBoundary(response.Header); ok {
+		// The parts are checked against the requested range while they are read, only their payload is written
+		byteRanges = newByteRangesReader(response.Body, boundary, rangeStart, rangeEnd, fileSize)
+		responseSize = rangeEnd - rangeStart + 1
+	} else {
+		first, last, total, err := parseContentRange(response.Header.Get("Content-Range"))
+		if err != nil {
+			return writeRangeStart, err
+		}
+		// A range cut short at the end of a file that got shorter is reported as the size mismatch it is
+		if err := checkTotal(total, fileSize); err != nil {
+			return writeRangeStart, err
+		}
+		if first != rangeStart || last != rangeEnd {
+			return writeRangeStart, fmt.Errorf("Server Error: requested bytes %d-%d but got %d-%d", rangeStart, rangeEnd, first, last)
+		}
+	}
+	watchdog := d.watchStalls(response.Body)
+	defer watchdog.stop()
+
+	// borrow a buffer to read chunks from the response, it is returned to the pool for the next chunk
+	pooled := d.buffers.Get().(*[]byte)
+	defer d.buffers.Put(pooled)
+	buff := *pooled
+	// wrote counts the bytes written, with parts out of order some of them can be past writeRangeStart
+	var wrote int64
+	defer func() {
+		// Those bytes are downloaded again with the rest of the chunk, so they are not counted twice
+		if extra := wrote - (writeRangeStart - rangeStart); extra > 0 {
+			atomic.AddInt64(downloaded, -extra)
+		}
+	}()
+	for {
+		// Stop promptly on cancellation, even if the response still has buffered bytes to read
+		if ctx.Err() != nil {
+			return writeRangeStart, ctx.Err()
+		}
+		watchdog.start()
+		var bytesRead int
+		var readErr error
+		offset := writeRangeStart
+		if byteRanges != nil {
+			bytesRead, offset, readErr = byteRanges.read(buff)
+		} else {
+			bytesRead, readErr = response.Body.Read(buff)
+		}
+		watchdog.stop()
+		if err := watchdog.err(); err != nil {
+			return writeRangeStart, err
+		}
+		if d.limiter != nil && bytesRead > 0 {
+			if err := d.limiter.wait(ctx, bytesRead); err != nil {
+				return writeRangeStart, err
+			}
+		}
+		// A read can return bytes together with io.EOF, so they are written before checking the error
+		if bytesRead > 0 {
+			bytesWritten, writeErr := fileToWrite.WriteAt(buff[0:bytesRead], offset)
+			wrote += int64(bytesWritten)
+			if byteRanges != nil {
+				byteRanges.wrote(offset, int64(bytesWritten))
+				writeRangeStart = byteRanges.completed()
+			} else {
+				writeRangeStart += int64(bytesWritten)
+			}
+			atomic.AddInt64(downloaded, int64(bytesWritten))
+			d.Metrics.AddBytes(response.Request.URL.Host, bytesWritten)
+			if written != nil {
+				atomic.StoreInt64(written, writeRangeStart)
+			}
+			if writeErr != nil {
+				return writeRangeStart, fmt.Errorf("Error during WRITE: %s", writeErr.Error())
+			}
+			if bytesRead != bytesWritten {
+				return writeRangeStart, errors.New("Error occurred during writing, bytes read and bytes written do not match")
+			}
+		}
+		if errors.Is(readErr, io.EOF) {
+			if responseSize != (writeRangeStart - rangeStart) {
+				return writeRangeStart, fmt.Errorf("Error during READ, reached EOF after %d of %d bytes", writeRangeStart-rangeStart, responseSize)
+			}
+			d.debugf("Chunk %d received %s", currChunk+1, formatThroughput(writeRangeStart-rangeStart, time.Since(startTime), response.Request.URL.String()))
+			d.printAboveProgress(fmt.Sprint("Downloaded chunk ", currChunk+1, " successfully!"))
+			return writeRangeStart, nil
+		} else if readErr != nil {
+			return writeRangeStart, fmt.Errorf("Error during READ: %w", readErr)
+		}
+	}
+}
+
+// ChunkError is the error of a single chunk that failed to download
+type ChunkError struct {
+	// Chunk is the index of the chunk, starting from 0
+	Chunk int64
+	Err   error
+	// writtenUpTo is the offset up to which the chunk's bytes were written before it failed
+	writtenUpTo int64
+}
+
+func (e *ChunkError) Error() string {
+	return fmt.Sprintf("chunk %d: %s", e.Chunk+1, e.Err.Error())
+}
+
+func (e *ChunkError) Unwrap() error {
+	return e.Err
+}
+
+// ChunksError is returned by Download when one or more chunks failed to download
+// Every chunk is attempted before giving up, so Failed lists all chunks that failed
+type ChunksError struct {
+	Failed []*ChunkError
+	// Chunks is the number of chunks the download was split into
+	Chunks int64
+}
+
+func (e *ChunksError) Error() string {
+	return fmt.Sprint(len(e.Failed), " of ", e.Chunks, " chunks failed to download")
+}
+
+// Unwrap returns the errors of the failed chunks, so that errors.Is and errors.As find why they failed
+func (e *ChunksError) Unwrap() []error {
+	errs := make([]error, 0, len(e.Failed))
+	for _, chunkErr := range e.Failed {
+		errs = append(errs, chunkErr)
+	}
+	return errs
+}
+
+// slowestChunks is the number of chunks printed by printSlowestChunks
+const slowestChunks = 3
+
+// chunkTiming is the time a chunk took from getting a connection slot to being completely written,
+// including its retries, when it was done, and the source its last bytes came from
+type chunkTiming struct {
+	chunk    int64
+	bytes    int64
+	elapsed  time.Duration
+	finished time.Time
+	source   string
+}
+
+// chunkTimings collects the timings of the chunks, add is called concurrently by the chunk goroutines
+type chunkTimings struct {
+	mu sync.Mutex
+	// start is when the first chunk was started
+	start   time.Time
+	timings []chunkTiming
+}
+
+// newChunkTimings returns the timings of chunks starting now
+func newChunkTimings() *chunkTimings {
+	return &chunkTimings{start: time.Now()}
+}
+
+// ChunkStats tells how evenly the time was spread across the chunks, i.e. whether a few slow chunks held up
+// the download, which more concurrency does not help with but another mirror might
+// Only the chunks requested one per request are timed, a chunk retried in another pass from that pass on
+type ChunkStats struct {
+	// Slowest is the index of the chunk that took the longest, from 0, and SlowestTime is how long it took
+	Slowest     int64
+	SlowestTime time.Duration
+	// Last is the index of the chunk that finished last, on which the download waited
+	Last int64
+	// FastestTime and AverageTime are the time of the fastest chunk and the average time of the chunks
+	FastestTime time.Duration
+	AverageTime time.Duration
+	// StragglerCost is how much longer all chunks took from the start of the first one to the end of the last one
+	// than the average chunk, which includes the time the chunks waited for a free slot with MaxConcurrent
+	StragglerCost time.Duration
+}
+
+// stats returns the ChunkStats of the chunks, nil if fewer than 2 were timed or t is nil, as for a single stream
+func (t *chunkTimings) stats() *ChunkStats {
+	if t == nil {
+		return nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if len(t.timings) < 2 {
+		return nil
+	}
+	stats := &ChunkStats{FastestTime: t.timings[0].elapsed}
+	var total time.Duration
+	var lastFinished time.Time
+	for _, timing := range t.timings {
+		total += timing.elapsed
+		if timing.elapsed > stats.SlowestTime {
+			stats.Slowest, stats.SlowestTime = timing.chunk, timing.elapsed
+		}
+		if timing.elapsed < stats.FastestTime {
+			stats.FastestTime = timing.elapsed
+		}
+		if timing.finished.After(lastFinished) {
+			stats.Last, lastFinished = timing.chunk, timing.finished
+		}
+	}
+	stats.AverageTime = total / time.Duration(len(t.timings))
+	if cost := lastFinished.Sub(t.start) - stats.AverageTime; cost > 0 {
+		stats.StragglerCost = cost
+	}
+	return stats
+}
+
+func (t *chunkTimings) add(timing chunkTiming) {
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	t.timings = append(t.timings, timing)
+}
+
+// printSlowestChunks prints the chunks with the lowest throughput, to spot a slow mirror or CDN edge
+func (d *Downloader) printSlowestChunks(t *chunkTimings) {
+	if len(t.timings) < 2 {
+		return
+	}
+	sort.Slice(t.timings, func(i, j int) bool {
+		return float64(t.timings[i].bytes)/t.timings[i].elapsed.Seconds() < float64(t.timings[j].bytes)/t.timings[j].elapsed.Seconds()
+	})
+	d.debugf("Slowest chunks:")
+	n := slowestChunks
+	if n > len(t.timings) {
+		n = len(t.timings)
+	}
+	for _, timing := range t.timings[:n] {
+		d.debugf("  chunk %d: %s", timing.chunk+1, formatThroughput(timing.bytes, timing.elapsed, timing.source))
+	}
+}
+
+// formatThroughput returns "<bytes> bytes from <source> in <elapsed> ms (<speed>/s)"
+func formatThroughput(bytes int64, elapsed time.Duration, source string) string {
+	speed := "-"
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		speed = FormatBytes(int64(float64(bytes)/seconds)) + "/s"
+	}
+	return fmt.Sprintf("%d bytes from %s in %d ms (%s)", bytes, source, elapsed.Milliseconds(), speed)
+}
+
+// downloadWhole is the fallback for servers without HTTP Range support
+// It streams the whole object to the file over a single connection
+// The bytes arrive in order, so they are also written to hashWriter as they are downloaded if it is not nil
+// w does not need to be seekable, which is also what streaming to Downloader.Writer relies on
+// With d.AcceptEncoding, a gzip or deflate compressed response is decompressed, and the decompressed bytes are
+// written and hashed, ranged requests never ask for compression, as their offsets are those of the raw bytes
+func (d *Downloader) downloadWhole(ctx context.Context, dwLink string, w io.Writer, hashWriter io.Writer, downloaded *int64) error {
+	d.Metrics.ChunkStarted()
+	defer d.Metrics.ChunkDone()
+	craftRequest, err := d.newRequest(ctx, "GET", dwLink)
+	if err != nil {
+		return err
+	}
+	if d.AcceptEncoding {
+		craftRequest.Header.Set("Accept-Encoding", "gzip, deflate")
+	}
+	response, err := d.Client.Do(craftRequest)
+	if err != nil {
+		d.debugf("GET %s failed: %s", dwLink, err)
+		return err
+	}
+	d.debugf("GET %s: %s %s", dwLink, response.Proto, response.Status)
+	defer response.Body.Close()
+	if response.StatusCode != http.StatusOK {
+		return fmt.Errorf("HTTP error: GET request failed: %w", &StatusError{StatusCode: response.StatusCode, Status: response.Status})
+	}
+	watchdog := d.watchStalls(response.Body)
+	defer watchdog.stop()
+	var obj io.Reader = response.Body
+	encoding := response.Header.Get("Content-Encoding")
+	if d.AcceptEncoding && encoding != "" && encoding != "identity" {
+		if obj, err = decompress(response.Body, encoding); err != nil {
+			return err
+		}
+		d.println("Decompressing the", encoding, "encoded response")
+	}
+
+	// borrow a buffer to read chunks from the response, same as in writeChunks
+	var bytesTotal int64
+	pooled := d.buffers.Get().(*[]byte)
+	defer d.buffers.Put(pooled)
+	buff := *pooled
+	for {
+		watchdog.start()
+		bytesRead, readErr := obj.Read(buff)
+		watchdog.stop()
+		if err := watchdog.err(); err != nil {
+			return err
+		}
+		if d.limiter != nil && bytesRead > 0 {
+			if err := d.limiter.wait(ctx, bytesRead); err != nil {
+				return err
+			}
+		}
+		if bytesRead > 0 {
+			bytesWritten, writeErr := w.Write(buff[0:bytesRead])
+			bytesTotal += int64(bytesWritten)
+			atomic.AddInt64(downloaded, int64(bytesWritten))
+			d.Metrics.AddBytes(response.Request.URL.Host, bytesWritten)
+			if writeErr != nil {
+				return writeErr
+			}
+			if hashWriter != nil {
+				hashWriter.Write(buff[0:bytesRead])
+			}
+		}
+		if errors.Is(readErr, io.EOF) {
+			break
+		} else if readErr != nil {
+			return readErr
+		}
+	}
+	// Content-Length is the compressed size, a truncated compressed stream fails to decompress instead
+	if obj == response.Body && response.ContentLength >= 0 && response.ContentLength != bytesTotal {
+		return fmt.Errorf("Error during READ, expected %d bytes but got %d", response.ContentLength, bytesTotal)
+	}
+	d.printAboveProgress(fmt.Sprint("Downloaded ", bytesTotal, " bytes successfully!"))
+	return nil
+}
+
+// decompress returns a reader of the decompressed body for a gzip or deflate Content-Encoding
+// deflate should be zlib wrapped, but some servers send raw deflate, which is detected from the zlib header
+func decompress(body io.Reader, encoding string) (io.Reader, error) {
+	switch encoding {
+	case "gzip", "x-gzip":
+		reader, err := gzip.NewReader(body)
+		if err != nil {
+			return nil, fmt.Errorf("Error during READ, invalid gzip response: %w", err)
+		}
+		return reader, nil
+	case "deflate":
+		buffered := bufio.NewReader(body)
+		header, err := buffered.Peek(2)
+		if err != nil {
+			return nil, fmt.Errorf("Error during READ, invalid deflate response: %w", err)
+		}
+		// A zlib header has compression method 8 and is a multiple of 31
+		if header[0]&0x0f != 8 || (uint16(header[0])<<8|uint16(header[1]))%31 != 0 {
+			return flate.NewReader(buffered), nil
+		}
+		reader, err := zlib.NewReader(buffered)
+		if err != nil {
+			return nil, fmt.Errorf("Error during READ, invalid deflate response: %w", err)
+		}
+		return reader, nil
+	}
+	return nil, fmt.Errorf("Server Error: unsupported Content-Encoding %q", encoding)
+}
+
+// errFailFast is the error of the chunks canceled because another chunk failed with Downloader.FailFast set
+var errFailFast = errors.New("canceled because another chunk failed")
+
+// downloadChunks downloads the byte ranges of chunks in parallel from dwLinks with downloadChunksOnce,
+// then downloads the remaining bytes of the chunks that failed again, in up to d.RetryPasses more passes
+// With d.RangesPerRequest, the chunks are first requested several at a time by downloadBatches
+// The chunks that still fail after the last pass are returned, the time of every chunk that succeeded is added to timings
+// There is no further pass once ctx is canceled, with d.FailFast, if the file changed upstream,
+// or if a chunk reported another file size, and a chunk that failed with an HTTP status not in d.RetryOn is not retried
+func (d *Downloader) downloadChunks(ctx context.Context, dwLinks []string, file io.WriterAt, chunks []Chunk, fileSize int64, downloaded *int64, offsets []int64, timings *chunkTimings) []*ChunkError {
+	// The slowest chunks are printed with LogVerbose, to spot a slow mirror or CDN edge
+	if d.verbose() {
+		defer d.printSlowestChunks(timings)
+	}
+	if d.RangesPerRequest > 1 && len(chunks) > 1 {
+		chunks = d.downloadBatches(ctx, dwLinks, file, chunks, fileSize, downloaded, offsets)
+	}
+	failed := d.downloadChunksOnce(ctx, dwLinks, file, chunks, fileSize, downloaded, offsets, timings)
+	ends := map[int64]int64{}
+	for _, chunk := range chunks {
+		ends[chunk.Index] = chunk.End
+	}
+	for pass := 1; pass <= d.RetryPasses && len(failed) > 0 && ctx.Err() == nil && !d.FailFast; pass++ {
+		retry := make([]Chunk, 0, len(failed))
+		// permanent are the chunks that failed with an HTTP status that is not retried
+		var permanent []*ChunkError
+		for _, chunkErr := range failed {
+			if errors.Is(chunkErr.Err, ErrUpstreamChanged) || errors.Is(chunkErr.Err, ErrSizeMismatch) {
+				return failed
+			}
+			var statusErr *StatusError
+			if errors.As(chunkErr.Err, &statusErr) && !d.isRetryableStatus(statusErr.StatusCode) {
+				permanent = append(permanent, chunkErr)
+				continue
+			}
+			retry = append(retry, Chunk{Index: chunkErr.Chunk, Start: chunkErr.writtenUpTo, End: ends[chunkErr.Chunk]})
+			d.Metrics.ChunkRetried()
+		}
+		if len(retry) == 0 {
+			break
+		}
+		d.warnf("Downloading the %d failed chunk(s) again (pass %d of %d)", len(retry), pass+1, d.RetryPasses+1)
+		stillFailed := d.downloadChunksOnce(ctx, dwLinks, file, retry, fileSize, downloaded, offsets, timings)
+		failedAgain := map[int64]bool{}
+		for _, chunkErr := range stillFailed {
+			failedAgain[chunkErr.Chunk] = true
+		}
+		for _, chunk := range retry {
+			if !failedAgain[chunk.Index] {
+				d.printAboveProgress(fmt.Sprint("Recovered chunk ", chunk.Index+1, " in pass ", pass+1))
+			}
+		}
+		failed = append(permanent, stillFailed...)
+	}
+	return failed
+}
+
+// downloadChunksOnce downloads the byte ranges of chunks in parallel from dwLinks
+// At most d.MaxConcurrent chunks are in flight at any time, the others wait for a free slot
+// Every chunk is attempted, the errors of the chunks that failed are returned once all of them are done,
+// unless d.FailFast is set, then the first chunk to fail cancels the others
+// Chunks still waiting for a slot are abandoned when ctx is canceled
+// With mirrors, a chunk that is much slower than the best mirror is canceled and its remaining bytes
+// are requested from that mirror instead, they are written at the same offsets so nothing is written twice
+// If offsets is not nil, offsets[chunk.Index] is kept at the offset up to which every chunk has been written
+// If timings is not nil, the time every chunk that succeeded took is added to it
+func (d *Downloader) downloadChunksOnce(ctx context.Context, dwLinks []string, file io.WriterAt, chunks []Chunk, fileSize int64, downloaded *int64, offsets []int64, timings *chunkTimings) []*ChunkError {
+	var downloaderWg sync.WaitGroup
+	// Buffered so that no chunk goroutine ever blocks on reporting its error
+	errs := make(chan *ChunkError, len(chunks))
+	// Semaphore of MaxConcurrent tokens, a chunk holds one for as long as its request is in flight
+	tokens := make(chan struct{}, d.MaxConcurrent)
+	// With SlowStart, the chunks start with a few of the slots, and more are freed while the throughput improves
+	if d.SlowStart {
+		if held := holdSlowStartSlots(tokens); held > 0 {
+			slowStartDone := make(chan struct{})
+			defer close(slowStartDone)
+			go d.slowStart(tokens, held, downloaded, slowStartDone)
+		}
+	}
+	// With FailFast, the first chunk to fail cancels all the others through chunksCtx
+	chunksCtx, cancelChunks := context.WithCancel(ctx)
+	defer cancelChunks()
+	// A size mismatch cancels all chunks as well, whether FailFast is set or not
+	report := func(chunkErr *ChunkError) {
+		if (d.FailFast || errors.Is(chunkErr.Err, ErrSizeMismatch)) && ctx.Err() == nil {
+			cancelChunks()
+		}
+		if ctx.Err() == nil && chunksCtx.Err() != nil && errors.Is(chunkErr.Err, context.Canceled) {
+			chunkErr.Err = errFailFast
+		}
+		errs <- chunkErr
+	}
+	sched := newScheduler(len(dwLinks))
+	if len(dwLinks) > 1 {
+		schedDone := make(chan struct{})
+		defer close(schedDone)
+		go sched.run(schedDone)
+	}
+	for _, chunk := range chunks {
+		downloaderWg.Add(1)
+		var written *int64
+		if offsets != nil {
+			written = &offsets[chunk.Index]
+		}
+		go func(i int64, rangeStart int64, rangeEnd int64, file io.WriterAt, downloaderWg *sync.WaitGroup) {
+			defer downloaderWg.Done()
+			select {
+			case <-chunksCtx.Done():
+				report(&ChunkError{Chunk: i, writtenUpTo: rangeStart, Err: chunksCtx.Err()})
+				return
+			case tokens <- struct{}{}:
+			}
+			defer func() { <-tokens }()
+			// With Stagger, the requests of the chunks holding a token start one after the other instead of at once
+			if err := d.stagger.wait(chunksCtx); err != nil {
+				report(&ChunkError{Chunk: i, writtenUpTo: rangeStart, Err: err})
+				return
+			}
+			d.Metrics.ChunkStarted()
+			defer d.Metrics.ChunkDone()
+			startTime, startOffset := time.Now(), rangeStart
+			source := int(i) % len(dwLinks)
+			// retried counts the retries of chunks that timed out or stalled after their request succeeded
+			retried := 0
+			for {
+				// chunkCtx is canceled by the scheduler when the chunk is reassigned to another source
+				var chunkCtx context.Context
+				var cancel context.CancelFunc
+				if d.Timeout > 0 {
+					chunkCtx, cancel = context.WithTimeout(chunksCtx, d.Timeout)
+				} else {
+					chunkCtx, cancel = context.WithCancel(chunksCtx)
+				}
+				response, usedSource, err := d.getObjectRangeWithRetry(chunkCtx, dwLinks, source, i, rangeStart, rangeEnd)
+				if err != nil {
+					cancel()
+					var rangeErr *rangeNotSatisfiableError
+					if errors.As(err, &rangeErr) {
+						err = d.checkSizeAfterRangeError(chunksCtx, rangeErr, rangeStart, rangeEnd, fileSize)
+					}
+					if chunksCtx.Err() == nil && errors.Is(err, context.DeadlineExceeded) && retried < d.Retries {
+						retried++
+						d.Metrics.ChunkRetried()
+						d.warnf("Retrying chunk %d (retry %d of %d): request timed out after %s", i+1, retried, d.Retries, d.Timeout)
+						source = (source + 1) % len(dwLinks)
+						continue
+					}
+					report(&ChunkError{Chunk: i, writtenUpTo: rangeStart, Err: fmt.Errorf("Request error: %w", err)})
+					return
+				}
+				response.Body = sched.start(i, usedSource, cancel, response.Body)
+				writtenUpTo, err := d.writeChunks(chunkCtx, response, file, i, rangeStart, rangeEnd, fileSize, downloaded, written)
+				reassignTo := sched.finish(i)
+				cancel()
+				if err != nil && reassignTo != -1 && chunksCtx.Err() == nil {
+					d.warnf("Chunk %d is slow on %s, requesting its remaining bytes from %s", i+1, dwLinks[usedSource], dwLinks[reassignTo])
+					rangeStart, source = writtenUpTo, reassignTo
+					continue
+				}
+				// A stalled or timed out chunk only requests its remaining bytes again, from the next source
+				if err != nil && chunksCtx.Err() == nil && (errors.Is(err, errStalled) || errors.Is(err, context.DeadlineExceeded)) && retried < d.Retries {
+					retried++
+					d.Metrics.ChunkRetried()
+					d.warnf("Retrying chunk %d from byte %d (retry %d of %d): %s", i+1, writtenUpTo, retried, d.Retries, err.Error())
+					rangeStart, source = writtenUpTo, (usedSource+1)%len(dwLinks)
+					continue
+				}
+				if err != nil {
+					report(&ChunkError{Chunk: i, writtenUpTo: writtenUpTo, Err: err})
+				} else if timings != nil {
+					timings.add(chunkTiming{chunk: i, bytes: rangeEnd - startOffset + 1, elapsed: time.Since(startTime), finished: time.Now(), source: dwLinks[usedSource]})
+				}
+				return
+			}
+		}(chunk.Index, chunk.Start, chunk.End, file, &downloaderWg)
+	}
+	downloaderWg.Wait()
+	close(errs)
+
+	var failed []*ChunkError
+	for err := range errs {
+		failed = append(failed, err)
+	}
+	return failed
+}
+
+// contiguousPrefix returns the length of the start of the file that was completely written by downloadChunks
+// All chunks before the first failed one are complete, so it ends where that failed chunk stopped writing
+func contiguousPrefix(failed []*ChunkError) int64 {
+	prefix := failed[0].writtenUpTo
+	for _, chunkErr := range failed[1:] {
+		if chunkErr.writtenUpTo < prefix {
+			prefix = chunkErr.writtenUpTo
+		}
+	}
+	return prefix
+}
+
+// targetChunkSize is the chunk size ChunksForSize aims for: large enough to keep the overhead of a request low,
+// small enough that retrying a failed chunk is cheap
+const targetChunkSize = 16 << 20
+
+// maxAutoChunks is the maximum number of chunks ChunksForSize returns, so that huge files
+// are not split into thousands of requests
+const maxAutoChunks = 256
+
+// Chunk is the byte range of one chunk of a file, Start and End are inclusive offsets
+type Chunk struct {
+	// Index is the position of the chunk in the file, starting from 0
+	Index int64
+	Start int64
+	End   int64
+}
+
+// ComputeChunks splits a file of fileSize bytes into numChunks contiguous byte ranges of equal size,
+// the last chunk also holds the remainder and always ends at the last byte, fileSize-1
+// numChunks is capped at fileSize so that every chunk holds at least one byte, an empty file has no chunks
+func ComputeChunks(fileSize int64, numChunks int64) []Chunk {
+	if fileSize <= 0 {
+		return nil
+	}
+	if numChunks < 1 {
+		numChunks = 1
+	} else if numChunks > fileSize {
+		numChunks = fileSize
+	}
+	chunkSize := fileSize / numChunks
+	chunks := make([]Chunk, numChunks)
+	for i := range chunks {
+		start := int64(i) * chunkSize
+		// Ranges are inclusive, so a chunk ends one byte before the next one starts
+		end := start + chunkSize - 1
+		if i == len(chunks)-1 {
+			end = fileSize - 1
+		}
+		chunks[i] = Chunk{Index: int64(i), Start: start, End: end}
+	}
+	return chunks
+}
+
+// ChunksForSize returns the number of chunks a file of fileSize bytes is split into when Downloader.Chunks is not set
+// It aims for chunks of about 16 MiB, with at least one chunk and at most 256
+func ChunksForSize(fileSize int64) int64 {
+	chunks := (fileSize + targetChunkSize - 1) / targetChunkSize
+	if chunks < 1 {
+		return 1
+	}
+	if chunks > maxAutoChunks {
+		return maxAutoChunks
+	}
+	return chunks
+}
@@ -0,0 +1,332 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// writerAt is an io.WriterAt over a byte slice large enough for all writes
+type writerAt []byte
+
+func (w writerAt) WriteAt(p []byte, offset int64) (int, error) {
+	return copy(w[offset:], p), nil
+}
+
+// discardAt is an io.WriterAt that discards the bytes
+type discardAt struct{}
+
+func (discardAt) WriteAt(p []byte, offset int64) (int, error) {
+	return len(p), nil
+}
+
+// rangeResponse returns a 206 Partial Content response with body for the bytes from rangeStart to rangeEnd
+// of a file of fileSize bytes, as returned by getObjectRange
+func rangeResponse(body io.Reader, rangeStart int64, rangeEnd int64, fileSize int64) http.Response {
+	return http.Response{
+		StatusCode: http.StatusPartialContent,
+		Header: http.Header{
+			"Content-Length": {strconv.FormatInt(rangeEnd-rangeStart+1, 10)},
+			"Content-Range":  {fmt.Sprintf("bytes %d-%d/%d", rangeStart, rangeEnd, fileSize)},
+		},
+		Body:    io.NopCloser(body),
+		Request: &http.Request{URL: &url.URL{Scheme: "http", Host: "example.com", Path: "/file.bin"}},
+	}
+}
+
+// testDownloader returns a Downloader with the defaults filled in, as used by Download
+func testDownloader(t testing.TB, d Downloader) *Downloader {
+	t.Helper()
+	if d.URL == "" {
+		d.URL = "http://example.com/file.bin"
+	}
+	dl, err := d.withDefaults()
+	if err != nil {
+		t.Fatal(err)
+	}
+	return dl
+}
+
+// chunkTests are file sizes and chunk counts ComputeChunks is checked with: sizes that divide evenly
+// and ones that leave a remainder, tiny files, and more chunks than bytes
+var chunkTests = []struct {
+	fileSize  int64
+	numChunks int64
+}{
+	{1, 1}, {1, 4}, {2, 1}, {2, 2}, {2, 3}, {3, 2}, {3, 3}, {7, 3}, {10, 3}, {10, 10}, {10, 11}, {10, 100},
+	{100, 7}, {1000, 0}, {1000, -1}, {1 << 20, 10}, {1<<20 + 1, 16}, {5000003, 8}, {1 << 40, 256}, {1<<40 - 1, 255},
+}
+
+// TestComputeChunksContiguous checks that the chunks are numbered in order, start at byte 0, follow each other
+// without a gap, end at the last byte of the file, and that there are at most fileSize of them
+func TestComputeChunksContiguous(t *testing.T) {
+	for _, test := range chunkTests {
+		chunks := ComputeChunks(test.fileSize, test.numChunks)
+		want := min(max(test.numChunks, 1), test.fileSize)
+		if int64(len(chunks)) != want {
+			t.Errorf("ComputeChunks(%d, %d) returned %d chunks, want %d", test.fileSize, test.numChunks, len(chunks), want)
+			continue
+		}
+		next := int64(0)
+		for i, chunk := range chunks {
+			if chunk.Index != int64(i) || chunk.Start != next || chunk.End < chunk.Start {
+				t.Errorf("ComputeChunks(%d, %d): chunk %d is %+v, want index %d starting at %d", test.fileSize, test.numChunks, i, chunk, i, next)
+				break
+			}
+			next = chunk.End + 1
+		}
+		if next != test.fileSize {
+			t.Errorf("ComputeChunks(%d, %d) covers %d bytes, want %d", test.fileSize, test.numChunks, next, test.fileSize)
+		}
+	}
+}
+
+// TestComputeChunksEqualSize checks that all chunks but the last have the same size, and that the last one
+// holds the remainder, which is smaller than the number of chunks
+func TestComputeChunksEqualSize(t *testing.T) {
+	for _, test := range chunkTests {
+		chunks := ComputeChunks(test.fileSize, test.numChunks)
+		size := chunks[0].End - chunks[0].Start + 1
+		for _, chunk := range chunks[:len(chunks)-1] {
+			if chunk.End-chunk.Start+1 != size {
+				t.Errorf("ComputeChunks(%d, %d): chunk %+v is not %d bytes like the first", test.fileSize, test.numChunks, chunk, size)
+			}
+		}
+		last := chunks[len(chunks)-1]
+		if remainder := last.End - last.Start + 1 - size; remainder < 0 || remainder >= int64(len(chunks)) {
+			t.Errorf("ComputeChunks(%d, %d): last chunk %+v holds a remainder of %d bytes", test.fileSize, test.numChunks, last, remainder)
+		}
+	}
+}
+
+// TestComputeChunksSum checks that the byte counts of the chunks add up to the file size, with no byte
+// downloaded twice or left out
+func TestComputeChunksSum(t *testing.T) {
+	for _, test := range chunkTests {
+		var total int64
+		chunks := ComputeChunks(test.fileSize, test.numChunks)
+		for i, chunk := range chunks {
+			total += chunk.End - chunk.Start + 1
+			if i > 0 && chunk.Start <= chunks[i-1].End {
+				t.Errorf("ComputeChunks(%d, %d): chunk %+v overlaps %+v", test.fileSize, test.numChunks, chunk, chunks[i-1])
+			}
+			if i > 0 && chunk.Start > chunks[i-1].End+1 {
+				t.Errorf("ComputeChunks(%d, %d): gap between %+v and %+v", test.fileSize, test.numChunks, chunks[i-1], chunk)
+			}
+		}
+		if total != test.fileSize {
+			t.Errorf("ComputeChunks(%d, %d): chunks hold %d bytes, want %d", test.fileSize, test.numChunks, total, test.fileSize)
+		}
+	}
+}
+
+// BenchmarkWriteChunks writes a 1 MiB chunk through the pooled read buffers, the allocations per chunk
+// show whether the buffers are reused
+func BenchmarkWriteChunks(b *testing.B) {
+	d := testDownloader(b, Downloader{})
+	content := testContent(1 << 20)
+	size := int64(len(content))
+	var downloaded int64
+	b.ReportAllocs()
+	b.SetBytes(size)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		response := rangeResponse(bytes.NewReader(content), 0, size-1, size)
+		if _, err := d.writeChunks(context.Background(), response, discardAt{}, 0, 0, size-1, size, &downloaded, nil); err != nil {
+			b.Fatal(err)
+		}
+	}
+}
+
+// TestDownloadWholeChunkedEncoding checks that a response with chunked transfer encoding and no Content-Length
+// is downloaded whole, and hashed, in a single stream
+func TestDownloadWholeChunkedEncoding(t *testing.T) {
+	content := testContent(200000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		// Every flush sends the bytes written so far as a chunk of the response
+		for offset := 0; offset < len(content); offset += 30000 {
+			w.Write(content[offset:min(offset+30000, len(content))])
+			w.(http.Flusher).Flush()
+		}
+	}))
+	defer server.Close()
+
+	response, err := server.Client().Get(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	response.Body.Close()
+	if response.ContentLength != -1 || len(response.TransferEncoding) == 0 || response.TransferEncoding[0] != "chunked" {
+		t.Fatalf("test server sent Content-Length %d and Transfer-Encoding %v, want no length and chunked", response.ContentLength, response.TransferEncoding)
+	}
+
+	d := testDownloader(t, Downloader{URL: server.URL, Client: server.Client()})
+	var file bytes.Buffer
+	hash := sha256.New()
+	var downloaded int64
+	if err := d.downloadWhole(context.Background(), server.URL, &file, hash, &downloaded); err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(file.Bytes(), content) || downloaded != int64(len(content)) {
+		t.Fatalf("got %d bytes, %d counted as downloaded, want %d", file.Len(), downloaded, len(content))
+	}
+	if want := sha256.Sum256(content); !bytes.Equal(hash.Sum(nil), want[:]) {
+		t.Fatal("hash of the downloaded bytes does not match the content")
+	}
+}
+
+// TestComputeChunksTinyFiles checks that a 3-byte file is split into at most 3 one-byte chunks, never into
+// empty ranges like bytes=5-4, and that a 0-byte file has no chunks
+func TestComputeChunksTinyFiles(t *testing.T) {
+	for _, numChunks := range []int64{3, 4, 8, 100} {
+		want := []Chunk{{Index: 0, Start: 0, End: 0}, {Index: 1, Start: 1, End: 1}, {Index: 2, Start: 2, End: 2}}
+		if got := ComputeChunks(3, numChunks); fmt.Sprint(got) != fmt.Sprint(want) {
+			t.Errorf("ComputeChunks(3, %d) = %+v, want %+v", numChunks, got, want)
+		}
+	}
+	if got := ComputeChunks(3, 2); fmt.Sprint(got) != fmt.Sprint([]Chunk{{Index: 0, Start: 0, End: 0}, {Index: 1, Start: 1, End: 2}}) {
+		t.Errorf("ComputeChunks(3, 2) = %+v, want bytes 0-0 and 1-2", got)
+	}
+	for _, numChunks := range []int64{-1, 0, 1, 8} {
+		if got := ComputeChunks(0, numChunks); len(got) != 0 {
+			t.Errorf("ComputeChunks(0, %d) = %+v, want no chunks", numChunks, got)
+		}
+	}
+	for _, fileSize := range []int64{0, 3} {
+		if got := ChunksForSize(fileSize); got != 1 {
+			t.Errorf("ChunksForSize(%d) = %d, want 1", fileSize, got)
+		}
+	}
+}
+
+// dataEOFReader reads like a reader that returns the last bytes together with its end error, as many
+// network readers do, at most size bytes per call
+type dataEOFReader struct {
+	data []byte
+	size int
+	eof  error
+}
+
+func (r *dataEOFReader) Read(p []byte) (int, error) {
+	n := copy(p[:min(len(p), r.size)], r.data)
+	r.data = r.data[n:]
+	if len(r.data) == 0 {
+		return n, r.eof
+	}
+	return n, nil
+}
+
+// TestWriteChunksDataWithEOF checks that the bytes of a read that also returns io.EOF, or an error wrapping it,
+// are written before the chunk is finished
+func TestWriteChunksDataWithEOF(t *testing.T) {
+	content := testContent(3000)
+	for _, eof := range []error{io.EOF, fmt.Errorf("connection closed: %w", io.EOF)} {
+		d := testDownloader(t, Downloader{})
+		file := make(writerAt, len(content))
+		reader := &dataEOFReader{data: content[1000:2000], size: 300, eof: eof}
+		var downloaded int64
+		offset, err := d.writeChunks(context.Background(), rangeResponse(reader, 1000, 1999, 3000), file, 1, 1000, 1999, 3000, &downloaded, nil)
+		if err != nil {
+			t.Fatalf("%v: %v", eof, err)
+		}
+		if offset != 2000 || downloaded != 1000 {
+			t.Fatalf("%v: chunk ended at offset %d with %d bytes downloaded, want 2000 and 1000", eof, offset, downloaded)
+		}
+		if !bytes.Equal(file[1000:2000], content[1000:2000]) {
+			t.Fatalf("%v: written bytes do not match the content", eof)
+		}
+	}
+}
+
+// TestRangeNotSatisfiable checks that a range past the end of the file is returned as a *rangeNotSatisfiableError
+// with the size from the 416 response, and that the chunk error tells a file that changed size from one that did not
+func TestRangeNotSatisfiable(t *testing.T) {
+	server := httptest.NewServer(serveContent(testContent(1000)))
+	defer server.Close()
+	d := testDownloader(t, Downloader{URL: server.URL + "/file.bin", Client: server.Client()})
+
+	_, err := d.getObjectRange(context.Background(), d.URL, 1000, 1999)
+	var rangeErr *rangeNotSatisfiableError
+	if !errors.As(err, &rangeErr) || rangeErr.size != 1000 {
+		t.Fatalf("got %v, want a 416 error for a 1000 byte file", err)
+	}
+
+	if err := d.checkSizeAfterRangeError(context.Background(), rangeErr, 1000, 1999, 2000); !errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("got %v for a file that got shorter, want ErrSizeMismatch", err)
+	}
+	if err := d.checkSizeAfterRangeError(context.Background(), rangeErr, 1000, 1999, 1000); err == nil || errors.Is(err, ErrSizeMismatch) {
+		t.Errorf("got %v for a file of the same size, want an error without ErrSizeMismatch", err)
+	}
+	// Without a Content-Range in the 416 response, the size is probed again
+	unknown := &rangeNotSatisfiableError{dwLink: d.URL, size: -1}
+	if err := d.checkSizeAfterRangeError(context.Background(), unknown, 1000, 1999, 2000); !errors.Is(err, ErrSizeMismatch) || !strings.Contains(err.Error(), "now 1000 bytes") {
+		t.Errorf("got %v with the size probed again, want ErrSizeMismatch for a 1000 byte file", err)
+	}
+}
+
+// TestDownloadFileShrunk checks that a file that got shorter after the support check, so that the last chunks
+// are past its end, fails the download with ErrSizeMismatch instead of writing the error responses
+func TestDownloadFileShrunk(t *testing.T) {
+	content := testContent(100000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Range") == "" {
+			serveContent(content)(w, r)
+			return
+		}
+		serveContent(content[:60000])(w, r)
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "file.bin")
+	d := Downloader{URL: server.URL + "/file.bin", Client: server.Client(), OutputPath: output, Chunks: 4, Retries: 1}
+	if _, err := d.Download(context.Background()); !errors.Is(err, ErrSizeMismatch) {
+		t.Fatalf("got %v, want ErrSizeMismatch", err)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Fatalf("output file was created: %v", err)
+	}
+}
+
+// TestRetryAttempts checks that a chunk request that keeps failing is made (Retries+1)*(RetryPasses+1) times,
+// the passes do not multiply the retries any further
+func TestRetryAttempts(t *testing.T) {
+	content := testContent(1000)
+	for _, test := range []struct{ retries, passes int }{{0, 0}, {2, 0}, {0, 2}, {2, 1}, {3, 3}} {
+		var mu sync.Mutex
+		requests := map[string]int{}
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Header.Get("Range") == "" {
+				serveContent(content)(w, r)
+				return
+			}
+			mu.Lock()
+			requests[r.Header.Get("Range")]++
+			mu.Unlock()
+			w.Header().Set("Retry-After", "0")
+			w.WriteHeader(http.StatusServiceUnavailable)
+		}))
+		d := Downloader{URL: server.URL + "/file.bin", Client: server.Client(), OutputPath: filepath.Join(t.TempDir(), "file.bin"),
+			Chunks: 2, Retries: test.retries, RetryPasses: test.passes}
+		_, err := d.Download(context.Background())
+		server.Close()
+		if err == nil {
+			t.Fatalf("Retries %d, RetryPasses %d: download succeeded", test.retries, test.passes)
+		}
+		want := (test.retries + 1) * (test.passes + 1)
+		if len(requests) != 2 || requests["bytes=0-499"] != want || requests["bytes=500-999"] != want {
+			t.Errorf("Retries %d, RetryPasses %d: got requests %v, want %d for each chunk", test.retries, test.passes, requests, want)
+		}
+	}
+}
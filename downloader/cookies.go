@@ -0,0 +1,99 @@
+package downloader
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// readCookieFile parses the cookie file at path
+func readCookieFile(path string) ([]*http.Cookie, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	cookies, err := parseCookieFile(file, time.Now())
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return cookies, nil
+}
+
+// parseCookieFile parses a cookie file in the Netscape format written by curl, wget and browser extensions,
+// one cookie per line with the tab-separated fields domain, include subdomains, path, secure, expiry, name and value
+// The cookies expired at now are skipped, an expiry of 0 is a session cookie
+// A domain of a cookie that includes the subdomains gets a leading dot, see cookieMatches
+func parseCookieFile(r io.Reader, now time.Time) ([]*http.Cookie, error) {
+	var cookies []*http.Cookie
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := strings.TrimRight(scanner.Text(), "\r")
+		// curl marks HttpOnly cookies with a prefix that otherwise looks like a comment
+		httpOnly := strings.HasPrefix(text, "#HttpOnly_")
+		text = strings.TrimPrefix(text, "#HttpOnly_")
+		if strings.TrimSpace(text) == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		fields := strings.Split(text, "\t")
+		if len(fields) != 7 {
+			return nil, fmt.Errorf("line %d: expected 7 tab-separated fields, got %d", line, len(fields))
+		}
+		expiry, err := strconv.ParseInt(fields[4], 10, 64)
+		if err != nil {
+			return nil, fmt.Errorf("line %d: invalid expiry %q", line, fields[4])
+		}
+		if expiry != 0 && time.Unix(expiry, 0).Before(now) {
+			continue
+		}
+		domain := strings.TrimPrefix(fields[0], ".")
+		if strings.EqualFold(fields[1], "TRUE") {
+			domain = "." + domain
+		}
+		cookies = append(cookies, &http.Cookie{
+			Domain:   domain,
+			Path:     fields[2],
+			Secure:   strings.EqualFold(fields[3], "TRUE"),
+			Name:     fields[5],
+			Value:    fields[6],
+			HttpOnly: httpOnly,
+		})
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return cookies, nil
+}
+
+// cookieMatches reports whether cookie is sent with a request to target
+// A cookie without a domain is sent to every host, one whose domain starts with a dot to that host and its subdomains
+func cookieMatches(cookie *http.Cookie, target *url.URL) bool {
+	host := strings.ToLower(target.Hostname())
+	domain := strings.ToLower(cookie.Domain)
+	switch {
+	case domain == "":
+	case strings.HasPrefix(domain, "."):
+		if host != domain[1:] && !strings.HasSuffix(host, domain) {
+			return false
+		}
+	case host != domain:
+		return false
+	}
+	if cookie.Secure && target.Scheme != "https" {
+		return false
+	}
+	if cookie.Path == "" || cookie.Path == "/" {
+		return true
+	}
+	path := target.Path
+	if path == "" {
+		path = "/"
+	}
+	return path == cookie.Path || strings.HasPrefix(path, strings.TrimSuffix(cookie.Path, "/")+"/")
+}
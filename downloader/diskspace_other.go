@@ -0,0 +1,9 @@
+//go:build !linux && !darwin && !freebsd
+// +build !linux,!darwin,!freebsd
+
+package downloader
+
+// availableSpace cannot determine the available space on this platform, so the check is skipped
+func availableSpace(dir string) (int64, bool) {
+	return 0, false
+}
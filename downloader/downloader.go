@@ -0,0 +1,1122 @@
+// Package downloader downloads files in multiple chunks in parallel using HTTP Range requests,
+// falling back to a single stream for servers that do not support them
+package downloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"log/slog"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Version is the version of the downloader, sent in DefaultUserAgent
+const Version = "1.0.0"
+
+// DefaultUserAgent is the User-Agent header sent when Downloader.UserAgent is not set
+const DefaultUserAgent = "multi-source-downloader/" + Version
+
+// DefaultBufferSize is the size of the read buffers when Downloader.BufferSize is not set
+const DefaultBufferSize = 64 * 1024
+
+// DefaultMaxConcurrent is the number of chunks downloaded at the same time when neither
+// Downloader.Chunks nor Downloader.MaxConcurrent is set
+const DefaultMaxConcurrent = 10
+
+// DefaultMaxRedirects is the number of redirects followed when Downloader.MaxRedirects is not set,
+// the same as Go's http.Client
+const DefaultMaxRedirects = 10
+
+// DefaultRetryOn are the HTTP statuses of a chunk request that are retried when Downloader.RetryOn is not set:
+// rate limiting and the server errors that are usually transient
+var DefaultRetryOn = []int{http.StatusTooManyRequests, http.StatusInternalServerError, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout}
+
+// ErrNoSpace is returned when the filesystem of the output file does not have room for it
+// and Downloader.SkipSpaceCheck is not set
+var ErrNoSpace = errors.New("not enough disk space")
+
+// ErrRangesNotSupported is returned by Download when only a range of the file is to be downloaded,
+// but the server does not support HTTP Range requests
+var ErrRangesNotSupported = errors.New("the server does not support HTTP Range requests")
+
+// InputError is returned for an invalid configuration of the Downloader, or a range past the end of the file,
+// its message starts with "Bad Input"
+// Nothing is downloaded then, and retrying with the same configuration fails the same way
+type InputError struct {
+	Err error
+}
+
+func (e *InputError) Error() string {
+	return e.Err.Error()
+}
+
+func (e *InputError) Unwrap() error {
+	return e.Err
+}
+
+// ErrFileExists is returned when the output file already exists and Downloader.Overwrite is not set
+var ErrFileExists = errors.New("output file already exists")
+
+// Downloader holds the configuration for downloading a single file
+// The zero value of every field except URL is usable, Download does not modify the Downloader
+type Downloader struct {
+	// URL of the file to download
+	URL string
+	// Mirrors are other URLs serving the same file, chunks are spread across them and URL round-robin
+	// and a failed chunk is retried on the next one
+	Mirrors []string
+	// OutputPath is where the file is saved, by default the filename from the Content-Disposition header
+	// or else from the URL in the current directory
+	OutputPath string
+	// Writer, if set, receives the file instead of saving it to OutputPath, e.g. os.Stdout
+	// Writers are not seekable, so the file is downloaded in a single stream, and cannot be resumed
+	Writer io.Writer
+	// Storage, if set, receives the chunks instead of OutputPath, e.g. to upload them to object storage
+	// without a local file, its Finalize method is called once the download is complete
+	Storage Storage
+	// OutputDir is the directory relative output paths, including the default filename, are saved in,
+	// it is created if it does not exist
+	OutputDir string
+	// FilenameTemplate names the file saved without OutputPath from its default filename, e.g. "{basename}-{date}.{ext}":
+	// {basename} and {ext} are the default filename without and with only its extension, {date} is the date of the download,
+	// {host} the host of URL, and {sha256-short} the first 8 hex digits of the SHA256 checksum, the last one is only
+	// known once the file is downloaded, so it is only replaced when the .part file is renamed
+	FilenameTemplate string
+	// DetectExtension appends the extension of the Content-Type of the file to the filename it is saved under
+	// without OutputPath, e.g. .gz for application/gzip, unless it already ends with one of the extensions of that type
+	// The extension is appended before FilenameTemplate is expanded, so that {ext} is the detected one
+	DetectExtension bool
+	// RangeStart and RangeLength select the bytes of the remote file that are downloaded, starting at byte
+	// RangeStart and RangeLength bytes long, or up to the end of the file if RangeLength is 0
+	// The range is saved at the start of the output, and the checksums are those of the range only
+	RangeStart  int64
+	RangeLength int64
+	// Chunks is the number of chunks the file is split into, if 0 it is derived from the file size by ChunksForSize
+	// It is capped at the file size so that every chunk holds at least one byte
+	Chunks int64
+	// MaxConcurrent is the maximum number of chunks downloaded at the same time,
+	// if 0 it is Chunks, or DefaultMaxConcurrent if Chunks is 0 as well
+	MaxConcurrent int64
+	// AcceptEncoding asks for a gzip or deflate compressed response when the file is downloaded in a single stream,
+	// which is decompressed on the fly, so the file and its checksums are those of the decompressed bytes
+	// Chunks are never compressed, as their byte ranges must be those of the file
+	AcceptEncoding bool
+	// RangesPerRequest requests up to that many chunks in a single multi-range request, e.g. Range: bytes=0-99,200-299,
+	// so that many small chunks do not cost a request each, 0 or 1 requests every chunk on its own
+	// If the server answers with the whole file as it does not support multi-range requests, and for the chunks
+	// of a request that failed, the chunks are requested one at a time instead
+	RangesPerRequest int
+	// SlowStart starts with 2 chunks at the same time instead of MaxConcurrent, and doubles them every 2 seconds
+	// up to MaxConcurrent, as long as the throughput keeps improving, so that the server is not hit by all of them at once
+	SlowStart bool
+	// Stagger is the minimum delay between the starts of two chunk requests, so that a rate-limited server is not hit
+	// by all of them in the same millisecond, the chunks still run MaxConcurrent at a time once started, disabled if 0
+	Stagger time.Duration
+	// Retries is the number of times a failed chunk request is retried with exponential backoff
+	// With RetryPasses, a chunk request is made at most (Retries+1)*(RetryPasses+1) times in total
+	Retries int
+	// RetryPasses is the number of further passes over the chunks that still failed after their retries,
+	// in which their remaining bytes are requested again, with Retries retries each, none if 0
+	RetryPasses int
+	// RetryOn are the HTTP statuses of a chunk request that are retried, DefaultRetryOn if empty
+	// Any other status fails the chunk right away, without retrying it in a later pass either
+	RetryOn []int
+	// Timeout is the maximum time for requesting and reading a single chunk, unlimited if 0
+	// A chunk that times out is retried for its remaining bytes, up to Retries times
+	Timeout time.Duration
+	// StallTimeout aborts a chunk or single stream download when no bytes arrive for that long, disabled if 0
+	// A stalled chunk is retried for its remaining bytes, up to Retries times
+	// With the default client, it is also the maximum time to wait for the response headers
+	StallTimeout time.Duration
+	// FailFast cancels all chunks as soon as one of them fails, instead of attempting every chunk
+	FailFast bool
+	// Overwrite replaces an existing file at the output path, otherwise the download fails with ErrFileExists
+	// unless ConfirmOverwrite returns true
+	Overwrite bool
+	// ConfirmOverwrite, if set, is asked whether to replace the existing file at path when Overwrite is not set,
+	// e.g. to prompt the user
+	ConfirmOverwrite func(path string) bool
+	// FileMode is the permission bits of the saved file, e.g. 0755 for an executable or 0600 for a secret
+	// If 0, the file is created with 0666 before the umask
+	FileMode os.FileMode
+	// SkipSpaceCheck downloads the file even if the filesystem of the output file does not seem to have room for it,
+	// otherwise the download fails with ErrNoSpace before it starts, on platforms where the free space is known
+	SkipSpaceCheck bool
+	// DryRun only checks the server and prints the resolved URL, file size, output path and chunk ranges to Log,
+	// without creating the output file or downloading anything
+	DryRun bool
+	// Resume continues from the OutputPath.part file left by a previous failed, canceled or crashed download
+	// The progress of every chunk is saved to OutputPath.part.json while downloading, and removed once complete
+	Resume bool
+	// ResumeVerify, with Resume, reads the complete chunks of the .part file back before resuming, and downloads
+	// those that no longer match the checksum saved in the manifest when they were completed again, e.g. after a disk error
+	ResumeVerify bool
+	// Client is used for all requests, NewHTTPClient(MaxConcurrent) if nil
+	// Set it to use a custom transport, proxy or timeouts, or a stub server such as an httptest.Server's client
+	Client *http.Client
+	// MaxRedirects is the maximum number of redirects followed for a request, DefaultMaxRedirects if 0
+	// A redirect back to a URL already visited fails right away as a redirect loop
+	MaxRedirects int
+	// NoRedirects fails a request that is answered with a redirect instead of following it
+	NoRedirects bool
+	// SourceIP is the local address all connections are made from, e.g. to pick the network on a multi-homed machine,
+	// it also only applies to the default client
+	SourceIP net.IP
+	// IPFamily selects whether connections are made over IPv4, IPv6 or whichever connects first, the default,
+	// it also only applies to the default client
+	IPFamily IPFamily
+	// HTTP1 forces HTTP/1.1, for servers with buggy HTTP/2 range handling, otherwise HTTP/2 is used if the server
+	// supports it, it also only applies to the default client
+	HTTP1 bool
+	// InsecureSkipVerify disables the verification of the server's TLS certificate, e.g. for self-signed certificates
+	// It only applies to the default client, as it cannot change the transport of a custom Client
+	InsecureSkipVerify bool
+	// RootCAs are the certificate authorities trusted for the server's TLS certificate instead of the system ones,
+	// e.g. for a corporate PKI, it also only applies to the default client
+	RootCAs *x509.CertPool
+	// ClientCertificates are presented to servers asking for a TLS client certificate, e.g. for an mTLS protected
+	// registry, it also only applies to the default client
+	ClientCertificates []tls.Certificate
+	// Proxy is the proxy all requests go through, instead of the one from the HTTP_PROXY, HTTPS_PROXY
+	// and NO_PROXY environment variables, it also only applies to the default client
+	Proxy *url.URL
+	// UserAgent is sent as the User-Agent header with every request, DefaultUserAgent if empty
+	// A User-Agent in Header takes precedence
+	UserAgent string
+	// Header is sent with every request
+	Header http.Header
+	// User and Password are sent as HTTP Basic auth with every request if User is set
+	User     string
+	Password string
+	// Netrc is the path of a netrc file, whose login and password for the host of a request are sent as HTTP Basic auth
+	// if neither User nor BearerToken is set and Header holds no Authorization header, like in curl and wget
+	Netrc string
+	// Cookies are sent with every request they match, for downloads behind a session cookie
+	// A cookie without Domain is sent to every host, one with Domain only to that host, and to its subdomains
+	// if Domain starts with a dot, one with Path only for URLs below it and a Secure one only over https
+	Cookies []*http.Cookie
+	// CookieFile is the path of a cookie file in the Netscape format of curl and wget, whose cookies are sent
+	// like those of Cookies
+	CookieFile string
+	// BearerToken is sent as "Authorization: Bearer <token>" header with every request if set
+	BearerToken string
+	// Hashes are the checksum algorithms calculated for the file: md5, sha1, sha256, sha512 or crc32, DefaultHash if empty
+	Hashes []string
+	// Expected maps algorithms to the hex encoded checksums the file must match, compared case-insensitively
+	// Algorithms missing from Hashes are calculated as well
+	// On a mismatch the .part file is removed instead of being renamed to OutputPath
+	Expected map[string]string
+	// Merkle calculates a Merkle root over the SHA256 checksums of the chunks, hashed while they are written,
+	// instead of the checksums of the file, which read the whole file once more after downloading it
+	// See merkle.go for how the root is calculated
+	Merkle bool
+	// ExpectedMerkleRoot is the hex encoded Merkle root the file must match with Merkle
+	ExpectedMerkleRoot string
+	// VerifySidecar fetches the <URL>.sha256 file published next to the file and verifies the SHA256 checksum
+	// it lists for the file, in the sha256sum format, like an sha256 in Expected
+	VerifySidecar bool
+	// NoChecksum skips calculating the checksums, which otherwise reads the whole file once more after downloading it
+	NoChecksum bool
+	// BufferSize is the size of the buffer every chunk reads its response into, DefaultBufferSize if 0
+	// Larger buffers mean fewer system calls on fast connections
+	BufferSize int
+	// RateLimit is the maximum download rate in bytes per second, shared by all chunks, unlimited if 0
+	RateLimit int64
+	// Log receives the progress messages, nil discards them
+	// The chunks and the progress line write to it concurrently, every write is serialized so it need not be safe for concurrent use
+	Log io.Writer
+	// LogLevel controls which messages are written to Log
+	LogLevel LogLevel
+	// Logger, if set, receives the messages as structured records instead of Log, e.g. for log aggregation:
+	// those of LogVerbose at slog.LevelDebug, the retries at slog.LevelWarn and the others at slog.LevelInfo
+	// Its handler decides which of them are written, LogLevel is ignored then, and the progress line is not written
+	Logger *slog.Logger
+	// ProgressFunc, if set, is called every 500ms while downloading and once more at the end, with the bytes
+	// downloaded so far and the file size, 0 if unknown, e.g. to render a custom progress bar
+	// It is called from a single goroutine but must not block, as that delays the following calls
+	ProgressFunc func(downloaded, total int64)
+	// Metrics, if set, receives the bytes downloaded, the chunks in flight, the retries and the duration of every download
+	Metrics Metrics
+	// ThroughputLog, if set, receives a histogram of the bytes downloaded in every second once the download is done
+	ThroughputLog io.Writer
+
+	limiter *rateLimiter
+	// netrc holds the entries of the Netrc file
+	netrc   []netrcEntry
+	stagger *staggerGate
+	// authHosts are the hosts the credentials are sent to, see newRequest
+	authHosts *hostSet
+	// buffers is a pool of read buffers of BufferSize reused across chunks and retries
+	buffers *sync.Pool
+	// validators maps every URL chunks are requested from to the ETag or Last-Modified date it reported
+	validators map[string]string
+}
+
+// Result describes a completed download
+type Result struct {
+	// Path is where the file was saved, "" if it was written to Downloader.Writer
+	Path string
+	// Bytes is the size of the file
+	Bytes int64
+	// RangeStart and RangeLength select the bytes of the remote file that are downloaded, starting at byte
+	// RangeStart and RangeLength bytes long, or up to the end of the file if RangeLength is 0
+	// The range is saved at the start of the output, and the checksums are those of the range only
+	RangeStart  int64
+	RangeLength int64
+	// Chunks is the number of chunks the file was downloaded in, 1 for a single stream download
+	// and 0 if there was nothing to download
+	Chunks int64
+	// Elapsed is the time spent downloading, not including the checksum calculation
+	Elapsed time.Duration
+	// Checksums maps every algorithm of Downloader.Hashes and Downloader.Expected to the checksum of the file
+	// It is nil if Downloader.NoChecksum is set
+	Checksums map[string][]byte
+	// SHA256 is the SHA256 checksum of the file, nil if sha256 was not calculated
+	SHA256 []byte
+	// MerkleRoot is the Merkle root of the file with Downloader.Merkle, over MerkleChunks chunks
+	MerkleRoot   []byte
+	MerkleChunks int64
+	// ChunkStats tells which chunks were the slowest, nil for a single stream or fewer than 2 chunks
+	ChunkStats *ChunkStats
+}
+
+// withDefaults validates the configuration and returns a copy of it with the defaults filled in,
+// an invalid configuration is returned as an *InputError
+func (d *Downloader) withDefaults() (*Downloader, error) {
+	dl, err := d.applyDefaults()
+	if err != nil {
+		return nil, &InputError{Err: err}
+	}
+	return dl, nil
+}
+
+// applyDefaults is withDefaults without wrapping the errors
+func (d *Downloader) applyDefaults() (*Downloader, error) {
+	dl := *d
+	if dl.URL == "" {
+		return nil, errors.New("Bad Input: no URL to download")
+	}
+	if dl.Chunks < 0 {
+		return nil, fmt.Errorf("Bad Input: number of chunks must be at least 1, got %d", dl.Chunks)
+	}
+	if dl.RangesPerRequest < 0 {
+		return nil, fmt.Errorf("Bad Input: ranges per request cannot be negative, got %d", dl.RangesPerRequest)
+	}
+	if dl.MaxConcurrent < 0 {
+		return nil, fmt.Errorf("Bad Input: maximum concurrent chunks cannot be negative, got %d", dl.MaxConcurrent)
+	}
+	if dl.Storage != nil && (dl.Writer != nil || dl.Resume) {
+		return nil, errors.New("Bad Input: Storage cannot be combined with Writer or Resume")
+	}
+	if _, readable := dl.Storage.(io.ReaderAt); dl.Storage != nil && !readable && len(dl.Expected) > 0 {
+		return nil, errors.New("Bad Input: the checksums cannot be verified as the Storage does not implement io.ReaderAt")
+	}
+	if dl.RangeStart < 0 || dl.RangeLength < 0 {
+		return nil, fmt.Errorf("Bad Input: range start and length cannot be negative, got %d and %d", dl.RangeStart, dl.RangeLength)
+	}
+	if dl.Writer != nil && (dl.RangeStart > 0 || dl.RangeLength > 0) {
+		return nil, errors.New("Bad Input: a range of the file cannot be downloaded to Writer")
+	}
+	if dl.DryRun && (dl.Writer != nil || dl.Storage != nil) {
+		return nil, errors.New("Bad Input: DryRun cannot be combined with Writer or Storage")
+	}
+	if dl.Writer != nil && dl.Resume {
+		return nil, errors.New("Bad Input: a download to a writer cannot be resumed")
+	}
+	if dl.Timeout < 0 || dl.StallTimeout < 0 {
+		return nil, errors.New("Bad Input: timeouts cannot be negative")
+	}
+	if dl.FileMode&^os.ModePerm != 0 {
+		return nil, fmt.Errorf("Bad Input: file mode can only hold permission bits, got %#o", uint32(dl.FileMode))
+	}
+	if dl.BufferSize < 0 {
+		return nil, fmt.Errorf("Bad Input: buffer size cannot be negative, got %d", dl.BufferSize)
+	}
+	if dl.Stagger < 0 {
+		return nil, fmt.Errorf("Bad Input: stagger cannot be negative, got %s", dl.Stagger)
+	}
+	if dl.RateLimit < 0 {
+		return nil, fmt.Errorf("Bad Input: rate limit cannot be negative, got %d", dl.RateLimit)
+	}
+	if dl.Retries < 0 {
+		return nil, fmt.Errorf("Bad Input: number of retries cannot be negative, got %d", dl.Retries)
+	}
+	if dl.RetryPasses < 0 {
+		return nil, fmt.Errorf("Bad Input: number of retry passes cannot be negative, got %d", dl.RetryPasses)
+	}
+	for _, status := range dl.RetryOn {
+		if status < 400 || status > 599 {
+			return nil, fmt.Errorf("Bad Input: only 4xx and 5xx HTTP statuses can be retried, got %d", status)
+		}
+	}
+	if len(dl.RetryOn) == 0 {
+		dl.RetryOn = DefaultRetryOn
+	}
+	if dl.BearerToken != "" && dl.User != "" {
+		return nil, errors.New("Bad Input: a bearer token cannot be combined with HTTP Basic auth")
+	}
+	if dl.NoChecksum && len(dl.Expected) > 0 {
+		return nil, errors.New("Bad Input: checksums cannot be verified if they are not calculated")
+	}
+	if dl.VerifySidecar && (dl.NoChecksum || dl.Merkle || dl.Writer != nil || dl.Expected["sha256"] != "") {
+		return nil, errors.New("Bad Input: VerifySidecar cannot be combined with NoChecksum, Merkle, Writer or an expected sha256 checksum")
+	}
+	if dl.Merkle && (dl.NoChecksum || len(dl.Expected) > 0) {
+		return nil, errors.New("Bad Input: Merkle cannot be combined with NoChecksum or Expected, use ExpectedMerkleRoot")
+	}
+	if dl.ExpectedMerkleRoot != "" {
+		if !dl.Merkle {
+			return nil, errors.New("Bad Input: ExpectedMerkleRoot can only be verified with Merkle")
+		}
+		if sum, err := hex.DecodeString(dl.ExpectedMerkleRoot); err != nil || len(sum) != sha256.Size {
+			return nil, fmt.Errorf("Bad Input: expected Merkle root %q is not %d hex encoded bytes", dl.ExpectedMerkleRoot, sha256.Size)
+		}
+	}
+	// The Merkle root replaces the checksums of the file
+	if dl.Merkle {
+		dl.NoChecksum = true
+	}
+	if len(dl.Hashes) == 0 {
+		dl.Hashes = []string{DefaultHash}
+	}
+	// Copy Hashes before appending to it so that the caller's slice is never modified
+	dl.Hashes = append([]string(nil), dl.Hashes...)
+	for _, algorithm := range dl.Hashes {
+		if _, err := newHash(algorithm); err != nil {
+			return nil, fmt.Errorf("Bad Input: %w", err)
+		}
+	}
+	for algorithm, checksum := range dl.Expected {
+		h, err := newHash(algorithm)
+		if err != nil {
+			return nil, fmt.Errorf("Bad Input: %w", err)
+		}
+		if sum, err := hex.DecodeString(checksum); err != nil || len(sum) != h.Size() {
+			return nil, fmt.Errorf("Bad Input: expected %s checksum %q is not %d hex encoded bytes", algorithm, checksum, h.Size())
+		}
+		if !containsString(dl.Hashes, algorithm) {
+			dl.Hashes = append(dl.Hashes, algorithm)
+		}
+	}
+	// The checksum from the .sha256 file is only known once the download starts
+	if dl.VerifySidecar && !containsString(dl.Hashes, "sha256") {
+		dl.Hashes = append(dl.Hashes, "sha256")
+	}
+	if dl.FilenameTemplate != "" {
+		if err := CheckFilenameTemplate(dl.FilenameTemplate); err != nil {
+			return nil, fmt.Errorf("Bad Input: %w", err)
+		}
+		if dl.OutputPath != "" || dl.Writer != nil || dl.Storage != nil {
+			return nil, errors.New("Bad Input: a filename template cannot be combined with an output path, a writer or a storage")
+		}
+		if hasChecksumPlaceholder(dl.FilenameTemplate) && (dl.NoChecksum || !containsString(dl.Hashes, "sha256")) {
+			return nil, errors.New("Bad Input: {sha256-short} in the filename template requires the SHA256 checksum to be calculated")
+		}
+	}
+	if dl.MaxConcurrent == 0 {
+		dl.MaxConcurrent = dl.Chunks
+		if dl.Chunks == 0 {
+			dl.MaxConcurrent = DefaultMaxConcurrent
+		}
+	}
+	if dl.MaxRedirects < 0 {
+		return nil, fmt.Errorf("Bad Input: maximum number of redirects cannot be negative, got %d", dl.MaxRedirects)
+	}
+	if dl.NoRedirects && dl.MaxRedirects > 0 {
+		return nil, errors.New("Bad Input: NoRedirects cannot be combined with MaxRedirects")
+	}
+	if dl.Client != nil && dl.Client.CheckRedirect != nil && (dl.MaxRedirects > 0 || dl.NoRedirects) {
+		return nil, errors.New("Bad Input: MaxRedirects and NoRedirects cannot be combined with a Client that has its own CheckRedirect")
+	}
+	if dl.MaxRedirects == 0 {
+		dl.MaxRedirects = DefaultMaxRedirects
+	}
+	if dl.IPFamily < IPAuto || dl.IPFamily > IPv6 {
+		return nil, fmt.Errorf("Bad Input: unknown IP family %d", dl.IPFamily)
+	}
+	if dl.SourceIP != nil && ((dl.IPFamily == IPv4 && dl.SourceIP.To4() == nil) || (dl.IPFamily == IPv6 && dl.SourceIP.To4() != nil)) {
+		return nil, fmt.Errorf("Bad Input: source IP %s does not match the IP family", dl.SourceIP)
+	}
+	if dl.Client != nil && (dl.InsecureSkipVerify || dl.RootCAs != nil || len(dl.ClientCertificates) > 0 || dl.Proxy != nil || dl.HTTP1 || dl.SourceIP != nil || dl.IPFamily != IPAuto) {
+		return nil, errors.New("Bad Input: TLS certificate verification, client certificates, the proxy, HTTP1, SourceIP and IPFamily can only be configured for the default client")
+	}
+	if dl.Client == nil {
+		// One idle connection per concurrent chunk, so that every chunk can reuse a connection
+		dl.Client = NewHTTPClient(int(dl.MaxConcurrent))
+		// file:// URLs are served from the local filesystem with the same Range and If-Range support
+		// as an HTTP server, so local copies go through the same chunked download and verification
+		// The transport is only registered for a local URL, so that no server can have a local file read for it
+		if isFileURL(dl.URL) {
+			dl.Client.Transport.(*http.Transport).RegisterProtocol("file", http.NewFileTransport(http.Dir("/")))
+		}
+		if dl.InsecureSkipVerify || dl.RootCAs != nil || len(dl.ClientCertificates) > 0 {
+			dl.Client.Transport.(*http.Transport).TLSClientConfig = &tls.Config{
+				InsecureSkipVerify: dl.InsecureSkipVerify,
+				RootCAs:            dl.RootCAs,
+				Certificates:       dl.ClientCertificates,
+			}
+		}
+		if dl.Proxy != nil {
+			dl.Client.Transport.(*http.Transport).Proxy = http.ProxyURL(dl.Proxy)
+		}
+		dialer := newDialer(nil)
+		if dl.SourceIP != nil {
+			dialer = newDialer(&net.TCPAddr{IP: dl.SourceIP})
+		}
+		dl.Client.Transport.(*http.Transport).DialContext = dl.dialContext(dialer)
+		// An empty non-nil TLSNextProto disables HTTP/2, as the transport then never offers it to the server
+		if dl.HTTP1 {
+			dl.Client.Transport.(*http.Transport).ForceAttemptHTTP2 = false
+			dl.Client.Transport.(*http.Transport).TLSNextProto = map[string]func(string, *tls.Conn) http.RoundTripper{}
+		}
+		// A request can also hang before any byte of the body is read, on a half-open connection
+		// the response headers then never arrive, it is retried like any other failed request
+		if dl.StallTimeout > 0 {
+			dl.Client.Transport.(*http.Transport).ResponseHeaderTimeout = dl.StallTimeout
+		}
+	}
+	if dl.Client.CheckRedirect == nil {
+		// Copy the client so that the caller's client is never modified
+		client := *dl.Client
+		client.CheckRedirect = dl.checkRedirect
+		dl.Client = &client
+	}
+	if dl.BufferSize == 0 {
+		dl.BufferSize = DefaultBufferSize
+	}
+	bufferSize := dl.BufferSize
+	dl.buffers = &sync.Pool{New: func() interface{} {
+		buff := make([]byte, bufferSize)
+		return &buff
+	}}
+	if dl.RateLimit > 0 {
+		dl.limiter = newRateLimiter(dl.RateLimit)
+	}
+	if dl.Stagger > 0 {
+		dl.stagger = &staggerGate{interval: dl.Stagger}
+	}
+	// The credentials are only sent to the hosts the user chose, and to a redirect target that asks for them
+	dl.authHosts = newHostSet(append([]string{dl.URL}, dl.Mirrors...))
+	if dl.Netrc != "" {
+		entries, err := readNetrc(dl.Netrc)
+		if err != nil {
+			return nil, fmt.Errorf("Bad Input: could not read netrc file: %w", err)
+		}
+		dl.netrc = entries
+	}
+	if dl.CookieFile != "" {
+		cookies, err := readCookieFile(dl.CookieFile)
+		if err != nil {
+			return nil, fmt.Errorf("Bad Input: could not read cookie file: %w", err)
+		}
+		// The copy keeps the Cookies of d as they are
+		dl.Cookies = append(append([]*http.Cookie(nil), dl.Cookies...), cookies...)
+	}
+	if dl.UserAgent == "" {
+		dl.UserAgent = DefaultUserAgent
+	}
+	if dl.Log == nil {
+		dl.Log = io.Discard
+	} else {
+		dl.Log = &syncWriter{w: dl.Log}
+	}
+	if dl.Metrics == nil {
+		dl.Metrics = noMetrics{}
+	}
+	return &dl, nil
+}
+
+// Download downloads the file at d.URL to d.OutputPath, in parallel chunks if the server supports HTTP Range requests
+// The file is downloaded to a .part file in the same directory, that is only renamed to OutputPath once complete,
+// so that a failed download never leaves a partial file under the real name
+// Canceling ctx stops all chunks, the .part file is then removed, or kept for resuming if d.Resume is set
+// If chunks fail, the returned error wraps a *ChunksError listing them
+func (d *Downloader) Download(ctx context.Context) (*Result, error) {
+	dl, err := d.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	startTime := time.Now()
+	result, err := dl.download(ctx)
+	if !dl.DryRun {
+		dl.Metrics.DownloadDone(time.Since(startTime), err)
+	}
+	return result, err
+}
+
+// Probe runs the support check of Download without downloading anything: it follows the redirects of d.URL
+// and returns what the server reports about the file, e.g. to plan the chunks with ComputeChunks
+func (d *Downloader) Probe(ctx context.Context) (*RemoteInfo, error) {
+	dl, err := d.withDefaults()
+	if err != nil {
+		return nil, err
+	}
+	remote, err := dl.confirmSupport(ctx, dl.URL, true)
+	if err != nil {
+		return nil, fmt.Errorf("Fatal error in checking support for multi-source downloads: %w", err)
+	}
+	remote.ResolvedFilename = dl.resolveFilename(remote)
+	return remote, nil
+}
+
+// resolveFilename returns the filename the file is saved under without OutputPath, with the extension
+// of its Content-Type if DetectExtension is set, expanded with FilenameTemplate
+func (d *Downloader) resolveFilename(remote *RemoteInfo) string {
+	// A filename sent by the server is usually better than the URL's, e.g. for https://host/download?id=123
+	filename := remote.Filename
+	if filename == "" {
+		filename = getDownloadFileName(d.URL)
+	}
+	if d.DetectExtension {
+		filename = addExtension(filename, remote.ContentType)
+	}
+	if d.FilenameTemplate != "" {
+		filename = expandFilename(d.FilenameTemplate, filename, d.URL, time.Now())
+	}
+	return filename
+}
+
+func (d *Downloader) download(ctx context.Context) (*Result, error) {
+	// Check hosting server's support for HTTP Range requests, if yes, get fileSize
+	remote, err := d.confirmSupport(ctx, d.URL, true)
+	if err != nil {
+		return nil, fmt.Errorf("Fatal error in checking support for multi-source downloads: %w", err)
+	}
+	dwLinks := []string{remote.FinalURL}
+	d.validators = map[string]string{remote.FinalURL: remote.validator()}
+	if len(d.Mirrors) > 0 {
+		if remote.AcceptsRanges {
+			mirrors, err := d.confirmMirrors(ctx, remote)
+			if err != nil {
+				return nil, fmt.Errorf("Fatal error in checking mirrors: %w", err)
+			}
+			// Every mirror has its own validator, ETags in particular differ between servers
+			for _, mirror := range mirrors {
+				dwLinks = append(dwLinks, mirror.FinalURL)
+				d.validators[mirror.FinalURL] = mirror.validator()
+			}
+		} else {
+			d.println("Ignoring the mirrors, a single stream can only be downloaded from", d.URL)
+		}
+	}
+	if d.VerifySidecar {
+		checksum, err := d.fetchSidecar(ctx, remote)
+		if err != nil {
+			return nil, fmt.Errorf("Fatal error in fetching the .sha256 file: %w", err)
+		}
+		// Copy Expected before adding to it so that the caller's map is never modified
+		expected := map[string]string{"sha256": checksum}
+		for algorithm, want := range d.Expected {
+			expected[algorithm] = want
+		}
+		d.Expected = expected
+	}
+	fileSize, supportsRanges := remote.Size, remote.AcceptsRanges
+	if d.Writer != nil {
+		return d.downloadToWriter(ctx, remote)
+	}
+	// size is the number of bytes saved, the size of the remote file unless only a range of it is downloaded
+	rangeStart, size, err := d.byteRange(remote)
+	if err != nil {
+		return nil, err
+	}
+	if d.Storage != nil {
+		return d.downloadToStorage(ctx, remote, dwLinks, rangeStart, size)
+	}
+
+	resultFile := d.OutputPath
+	if resultFile == "" {
+		resultFile = d.resolveFilename(remote)
+	}
+	if d.OutputDir != "" {
+		if !d.DryRun {
+			if err := makeOutputDir(d.OutputDir); err != nil {
+				return nil, err
+			}
+		}
+		if !filepath.IsAbs(resultFile) {
+			resultFile = filepath.Join(d.OutputDir, resultFile)
+		}
+	}
+
+	if err := d.checkOverwrite(resultFile); err != nil {
+		return nil, err
+	}
+
+	// The rename of the .part file is atomic as both are on the same filesystem
+	// With Resume, a .part file left by a previous run holds the first downloadFrom bytes
+	// of the file and only the rest is downloaded, otherwise it is overwritten
+	// With Resume and a manifest of how far every chunk got, only their missing bytes are downloaded
+	downloadPath := resultFile + ".part"
+	manifestFile := manifestPath(downloadPath)
+	var downloadFrom int64
+	var progress *manifest
+	// corrupt is the number of chunks of the .part file found corrupt by ResumeVerify
+	var corrupt int
+	if d.Resume {
+		if partInfo, err := os.Stat(downloadPath); err == nil {
+			resumed, found := loadResumeManifest(downloadPath, remote, rangeStart, size, partInfo.Size())
+			switch {
+			case supportsRanges && resumed != nil:
+				progress = resumed
+				if d.ResumeVerify {
+					if corrupt, err = d.verifyResume(progress, downloadPath); err != nil {
+						return nil, err
+					}
+				}
+				downloadFrom = progress.completed()
+				d.println("Resuming ", downloadPath, " from ", manifestFile, ", ", downloadFrom, " of ", size, " bytes already downloaded")
+			case supportsRanges && found:
+				d.println("Remote file does not match ", manifestFile, ", starting over")
+			case supportsRanges && partInfo.Size() > size:
+				return nil, fmt.Errorf("Fatal error: %s is larger than the remote file, it changed upstream. Remove it to start over", downloadPath)
+			case supportsRanges:
+				downloadFrom = partInfo.Size()
+				d.println("Resuming ", downloadPath, " from byte ", downloadFrom, " of ", fileSize)
+			default:
+				d.println("Server does not support HTTP Range requests, cannot resume ", downloadPath, ", starting over")
+			}
+		}
+	}
+
+	// Never plan more chunks than there are bytes, otherwise some chunks would be empty
+	remainingSize := size - downloadFrom
+	numChunks := d.Chunks
+	if progress != nil {
+		numChunks = int64(len(progress.Chunks))
+	} else if numChunks == 0 {
+		numChunks = ChunksForSize(remainingSize)
+	} else if remainingSize > 0 && numChunks > remainingSize {
+		d.println("Requested ", numChunks, " chunks for ", remainingSize, " bytes, using ", remainingSize, " chunks instead")
+		numChunks = remainingSize
+	}
+
+	if d.MaxConcurrent > numChunks {
+		d.MaxConcurrent = numChunks
+	}
+	// Only the bytes after the downloadFrom bytes resumed from the .part file are split into chunks,
+	// the offsets of the remote file are shifted to the start of the .part file when downloading a range
+	var chunks []Chunk
+	if progress != nil {
+		chunks = progress.remaining()
+	} else if supportsRanges {
+		chunks = ComputeChunks(remainingSize, numChunks)
+		for i := range chunks {
+			chunks[i].Start += rangeStart + downloadFrom
+			chunks[i].End += rangeStart + downloadFrom
+		}
+		if d.Resume {
+			progress = newManifest(remote, rangeStart, size, downloadFrom, chunks)
+		}
+	}
+	if !d.SkipSpaceCheck {
+		if err := checkSpace(filepath.Dir(downloadPath), size-downloadFrom); err != nil {
+			return nil, err
+		}
+	}
+	if d.DryRun {
+		d.printPlan(remote, dwLinks, resultFile, downloadFrom, chunks)
+		return &Result{Path: resultFile, Chunks: int64(len(chunks))}, nil
+	}
+
+	// The file is also read to save the checksums of the complete chunks in the manifest
+	file, err := os.OpenFile(downloadPath, os.O_CREATE|os.O_RDWR, 0666)
+	if err != nil {
+		return nil, err
+	}
+	part := &partFile{File: file, finalPath: resultFile}
+	// Chmod applies the mode regardless of the umask, and also to a .part file left by a previous run
+	if d.FileMode != 0 {
+		if err := file.Chmod(d.FileMode); err != nil {
+			file.Close()
+			return nil, fmt.Errorf("Fatal error in setting the mode of %s: %w", downloadPath, err)
+		}
+	}
+	// Reserve the full size of the file up front, so that chunks written at arbitrary offsets
+	// do not grow it piece by piece, running out of disk space is detected by checkSpace before that
+	// This also drops any stale bytes if an existing, larger file is being overwritten
+	if err := file.Truncate(size); err != nil {
+		file.Close()
+		os.Remove(downloadPath)
+		return nil, fmt.Errorf("Fatal error in allocating %d bytes for %s: %w", size, downloadPath, err)
+	}
+	// The manifest is saved before downloading, so that a crash at any point leaves one behind
+	if progress != nil {
+		if err := progress.save(manifestFile); err != nil {
+			d.println("Could not save ", manifestFile, ", the download can only be resumed if it stops cleanly: ", err)
+			progress = nil
+		}
+	}
+
+	// downloaded is shared between the goroutines writing the file and the one printing progress
+	var downloaded = downloadFrom
+	progressDone := make(chan struct{})
+	progressStopped := make(chan struct{})
+	stopProgress := func() {
+		close(progressDone)
+		<-progressStopped
+	}
+	var hashes map[string]hash.Hash
+	var hashWriter io.Writer
+	// With Merkle, the chunks are hashed while they are written, a single stream is a single chunk
+	var tree *merkleTree
+	var leaf hash.Hash
+	if d.Merkle && supportsRanges {
+		tree = newMerkleTree(size, d.merkleChunks(size))
+	} else if d.Merkle {
+		leaf = newLeafHash()
+		hashWriter = leaf
+	}
+	// timings are the times of the chunks, nil for a single stream
+	var timings *chunkTimings
+	startTime := time.Now()
+	if supportsRanges && fileSize == 0 {
+		// There is no valid range for an empty file, bytes=0-0 would already be past its end
+		d.println("Remote file is empty, nothing to download")
+		numChunks = 0
+	} else if supportsRanges && remainingSize == 0 {
+		d.println("Nothing left to download, ", downloadPath, " is complete")
+		numChunks = 0
+	} else if supportsRanges {
+		d.println("Downloading ", resultFile, " in ", numChunks, " chunks, ", d.MaxConcurrent, " at a time from ", len(dwLinks), " source(s)...")
+		go d.printProgress(&downloaded, size, progressDone, progressStopped)
+		var offsets []int64
+		stopManifest := func() {}
+		if progress != nil {
+			offsets = progress.offsets()
+			manifestDone := make(chan struct{})
+			manifestStopped := make(chan struct{})
+			go d.saveManifest(progress, manifestFile, file, offsets, manifestDone, manifestStopped)
+			stopManifest = func() {
+				close(manifestDone)
+				<-manifestStopped
+			}
+		}
+		var w io.WriterAt = part
+		if tree != nil {
+			w = &merkleWriter{w: part, tree: tree}
+		}
+		timings = newChunkTimings()
+		failed := d.downloadChunks(ctx, dwLinks, &sectionWriter{w: w, base: rangeStart}, chunks, fileSize, &downloaded, offsets, timings)
+		stopManifest()
+		stopProgress()
+		if len(failed) > 0 {
+			var downloadErr error = &ChunksError{Failed: failed, Chunks: numChunks}
+			if ctx.Err() != nil {
+				// Every chunk still in flight fails with the cancellation, there is no point in listing them
+				downloadErr = fmt.Errorf("download canceled: %w", ctx.Err())
+			}
+			// The manifest keeps the bytes of every chunk, not only those of the complete start of the file
+			if progress != nil {
+				if err := progress.checkpoint(manifestFile, file, offsets); err == nil {
+					file.Close()
+					return nil, fmt.Errorf("%w, kept %d bytes in %s to resume from", downloadErr, progress.completed(), downloadPath)
+				}
+			}
+			if d.Resume {
+				os.Remove(manifestFile)
+				// Keep only the completely downloaded start of the file, so the next run can resume from its length
+				prefix := contiguousPrefix(failed)
+				file.Truncate(prefix)
+				file.Close()
+				return nil, fmt.Errorf("%w, kept %d bytes in %s to resume from", downloadErr, prefix, downloadPath)
+			}
+			file.Close()
+			os.Remove(downloadPath)
+			return nil, fmt.Errorf("%w, removed %s", downloadErr, downloadPath)
+		}
+	} else {
+		if !d.NoChecksum {
+			// The single stream is written in order, so it is hashed on the fly instead of reading the file again
+			if hashes, hashWriter, err = newHashes(d.Hashes); err != nil {
+				file.Close()
+				os.Remove(downloadPath)
+				return nil, err
+			}
+		}
+		d.println("Downloading ", resultFile, " in a single stream...")
+		numChunks = 1
+		go d.printProgress(&downloaded, fileSize, progressDone, progressStopped)
+		err := d.downloadWhole(ctx, remote.FinalURL, file, hashWriter, &downloaded)
+		stopProgress()
+		if err != nil {
+			file.Close()
+			os.Remove(downloadPath)
+			return nil, fmt.Errorf("Fatal error in single stream download: %w", err)
+		}
+		// A decompressed response need not be the size reserved up front
+		if err := file.Truncate(atomic.LoadInt64(&downloaded)); err != nil {
+			file.Close()
+			os.Remove(downloadPath)
+			return nil, fmt.Errorf("Fatal error in truncating %s: %w", downloadPath, err)
+		}
+	}
+	elapsed := time.Since(startTime)
+	file.Close()
+	// Once downloaded, the .part file is no longer resumed, so its manifest is removed with it
+	removePart := func() {
+		os.Remove(downloadPath)
+		os.Remove(manifestFile)
+	}
+	if supportsRanges {
+		if err := checkFileSize(downloadPath, size, atomic.LoadInt64(&downloaded)); err != nil {
+			removePart()
+			return nil, fmt.Errorf("Fatal error: %w, removed %s", err, downloadPath)
+		}
+	}
+	var checksums map[string][]byte
+	if hashes != nil {
+		checksums = sums(hashes)
+	} else if !d.NoChecksum {
+		checksums, err = calculateChecksums(downloadPath, d.Hashes)
+		if err != nil {
+			removePart()
+			return nil, fmt.Errorf("Error while calculating checksums: %w", err)
+		}
+	}
+	var merkleRoot []byte
+	var merkleChunks int64
+	if tree != nil {
+		merkleChunks = int64(len(tree.leaves))
+		if merkleRoot, err = d.merkleRootOfFile(tree, downloadPath); err != nil {
+			removePart()
+			return nil, fmt.Errorf("Error while calculating the Merkle root: %w", err)
+		}
+	} else if leaf != nil {
+		merkleRoot, merkleChunks = singleLeafRoot(leaf, atomic.LoadInt64(&downloaded))
+	}
+	if err := verifyChecksums(checksums, d.Expected); err != nil {
+		removePart()
+		return nil, err
+	}
+	if err := verifyMerkleRoot(merkleRoot, d.ExpectedMerkleRoot); err != nil {
+		removePart()
+		return nil, err
+	}
+	if hasChecksumPlaceholder(d.FilenameTemplate) {
+		resultFile = replaceChecksum(resultFile, checksums["sha256"])
+		if err := d.checkOverwrite(resultFile); err != nil {
+			removePart()
+			return nil, err
+		}
+		part.finalPath = resultFile
+	}
+	if err := part.Finalize(); err != nil {
+		removePart()
+		return nil, err
+	}
+	os.Remove(manifestFile)
+	if corrupt > 0 {
+		d.println("Repaired ", corrupt, " corrupt chunk(s)")
+	}
+	return &Result{
+		Path:         resultFile,
+		Bytes:        atomic.LoadInt64(&downloaded),
+		Chunks:       numChunks,
+		Elapsed:      elapsed,
+		Checksums:    checksums,
+		SHA256:       checksums["sha256"],
+		MerkleRoot:   merkleRoot,
+		MerkleChunks: merkleChunks,
+		ChunkStats:   timings.stats(),
+	}, nil
+}
+
+// checkOverwrite returns an error wrapping ErrFileExists if resultFile exists and is not to be overwritten
+func (d *Downloader) checkOverwrite(resultFile string) error {
+	if d.Overwrite || d.DryRun {
+		return nil
+	}
+	if _, err := os.Stat(resultFile); err == nil {
+		if d.ConfirmOverwrite == nil || !d.ConfirmOverwrite(resultFile) {
+			return fmt.Errorf("Bad Input: %s: %w", resultFile, ErrFileExists)
+		}
+	}
+	return nil
+}
+
+// merkleChunks returns the number of chunks of size bytes the Merkle root is calculated over,
+// the chunks of a fresh download regardless of how many bytes are already downloaded
+func (d *Downloader) merkleChunks(size int64) int64 {
+	if d.Chunks > 0 {
+		return d.Chunks
+	}
+	return ChunksForSize(size)
+}
+
+// merkleRootOfFile returns the Merkle root of the tree, reading the chunks that were not hashed
+// while downloading, e.g. the bytes resumed from a previous run, back from the file at filePath
+func (d *Downloader) merkleRootOfFile(tree *merkleTree, filePath string) ([]byte, error) {
+	if tree.complete() {
+		return d.merkleRoot(tree, nil)
+	}
+	file, err := os.Open(filePath)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	return d.merkleRoot(tree, file)
+}
+
+// byteRange returns the offset of the first byte to download and the number of bytes to download,
+// which is the whole remote file unless d.RangeStart or d.RangeLength is set
+func (d *Downloader) byteRange(remote *RemoteInfo) (int64, int64, error) {
+	if d.RangeStart == 0 && d.RangeLength == 0 {
+		return 0, remote.Size, nil
+	}
+	if !remote.AcceptsRanges {
+		return 0, 0, fmt.Errorf("Fatal error: %w, so a range of the file cannot be downloaded", ErrRangesNotSupported)
+	}
+	length := d.RangeLength
+	if length == 0 {
+		length = remote.Size - d.RangeStart
+	}
+	if d.RangeStart >= remote.Size || d.RangeStart+length > remote.Size {
+		return 0, 0, &InputError{Err: fmt.Errorf("Bad Input: range of %d bytes from byte %d is past the end of the %d byte file", length, d.RangeStart, remote.Size)}
+	}
+	d.println("Downloading bytes ", d.RangeStart, " to ", d.RangeStart+length-1, " of ", remote.Size)
+	return d.RangeStart, length, nil
+}
+
+// printPlan prints what download would do with DryRun: the resolved URL and file, and the ranges of the chunks
+// Without support for HTTP Range requests there are no chunks, as the file is downloaded in a single stream
+func (d *Downloader) printPlan(remote *RemoteInfo, dwLinks []string, resultFile string, downloadFrom int64, chunks []Chunk) {
+	d.println("URL:", remote.FinalURL)
+	if remote.Size <= 0 && !remote.AcceptsRanges {
+		d.println("Size: unknown")
+	} else {
+		d.println(fmt.Sprintf("Size: %d bytes (%s)", remote.Size, FormatBytes(remote.Size)))
+	}
+	d.println("Range requests supported:", remote.AcceptsRanges)
+	output := resultFile
+	if _, err := os.Stat(resultFile); err == nil {
+		output += " (exists)"
+	}
+	d.println("Output:", output)
+	if downloadFrom > 0 {
+		d.println(fmt.Sprintf("Resuming with %d bytes already downloaded to %s.part", downloadFrom, resultFile))
+	}
+	if !remote.AcceptsRanges {
+		d.println("Chunks: none, the file is downloaded in a single stream from", remote.FinalURL)
+		return
+	}
+	d.println(fmt.Sprintf("Chunks: %d, %d at a time from %d source(s)", len(chunks), d.MaxConcurrent, len(dwLinks)))
+	for _, chunk := range chunks {
+		d.println(fmt.Sprintf("  Chunk %d: bytes %d-%d (%d bytes) from %s", chunk.Index+1, chunk.Start, chunk.End, chunk.End-chunk.Start+1, dwLinks[int(chunk.Index)%len(dwLinks)]))
+	}
+}
+
+// downloadToWriter streams the file to d.Writer in a single stream, hashing it on the fly
+// As the bytes have already been written when the checksums are verified, a mismatch can only be reported
+func (d *Downloader) downloadToWriter(ctx context.Context, remote *RemoteInfo) (*Result, error) {
+	var hashes map[string]hash.Hash
+	var hashWriter io.Writer
+	if !d.NoChecksum {
+		var err error
+		if hashes, hashWriter, err = newHashes(d.Hashes); err != nil {
+			return nil, err
+		}
+	}
+	var leaf hash.Hash
+	if d.Merkle {
+		leaf = newLeafHash()
+		hashWriter = leaf
+	}
+	var downloaded int64
+	progressDone := make(chan struct{})
+	progressStopped := make(chan struct{})
+	d.println("Downloading in a single stream to the writer...")
+	startTime := time.Now()
+	go d.printProgress(&downloaded, remote.Size, progressDone, progressStopped)
+	err := d.downloadWhole(ctx, remote.FinalURL, d.Writer, hashWriter, &downloaded)
+	close(progressDone)
+	<-progressStopped
+	if err != nil {
+		return nil, fmt.Errorf("Fatal error in single stream download: %w", err)
+	}
+	result := &Result{Bytes: atomic.LoadInt64(&downloaded), Chunks: 1, Elapsed: time.Since(startTime)}
+	if hashes != nil {
+		result.Checksums = sums(hashes)
+		result.SHA256 = result.Checksums["sha256"]
+	}
+	if leaf != nil {
+		result.MerkleRoot, result.MerkleChunks = singleLeafRoot(leaf, result.Bytes)
+	}
+	if err := verifyChecksums(result.Checksums, d.Expected); err != nil {
+		return nil, err
+	}
+	if err := verifyMerkleRoot(result.MerkleRoot, d.ExpectedMerkleRoot); err != nil {
+		return nil, err
+	}
+	return result, nil
+}
+
+// spaceMargin returns the space kept free on top of the bytes to download: 1% of them plus 1 MiB,
+// for the manifest, the filesystem's own metadata and other files written in the meantime
+func spaceMargin(needed int64) int64 {
+	return needed/100 + 1<<20
+}
+
+// checkSpace checks that the filesystem of dir has room for needed more bytes and the spaceMargin
+// The .part file is truncated to its full size without allocating its blocks, so that alone does not fail early
+func checkSpace(dir string, needed int64) error {
+	available, ok := availableSpace(dir)
+	if !ok || needed <= 0 {
+		return nil
+	}
+	if available < needed+spaceMargin(needed) {
+		return fmt.Errorf("Fatal error: %s to download but only %s free in %s: %w", FormatBytes(needed), FormatBytes(available), dir, ErrNoSpace)
+	}
+	return nil
+}
+
+// makeOutputDir creates dir and its parents if it does not exist yet
+func makeOutputDir(dir string) error {
+	if info, err := os.Stat(dir); err == nil && !info.IsDir() {
+		return &InputError{Err: fmt.Errorf("Bad Input: output directory %s exists but is not a directory", dir)}
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return fmt.Errorf("Fatal error in creating output directory %s: %w", dir, err)
+	}
+	return nil
+}
+
+// checkFileSize checks that the file at filePath is fileSize bytes long and that all of them were downloaded
+// The file is truncated to fileSize before downloading, so a chunk that ended early would leave a gap
+// of zeros rather than a shorter file, which only the number of downloaded bytes reveals
+func checkFileSize(filePath string, fileSize int64, downloaded int64) error {
+	info, err := os.Stat(filePath)
+	if err != nil {
+		return err
+	}
+	if info.Size() != fileSize {
+		return fmt.Errorf("%s is %d bytes instead of the expected %d bytes", filePath, info.Size(), fileSize)
+	}
+	if downloaded != fileSize {
+		return fmt.Errorf("downloaded %d bytes instead of the expected %d bytes", downloaded, fileSize)
+	}
+	return nil
+}
+
+// containsString reports whether s is one of values
+func containsString(values []string, s string) bool {
+	for _, value := range values {
+		if value == s {
+			return true
+		}
+	}
+	return false
+}
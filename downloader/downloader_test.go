@@ -0,0 +1,285 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// downloadFrom downloads the file served by handler with d, through the client of an httptest server,
+// and returns the result and the downloaded bytes
+func downloadFrom(t *testing.T, handler http.Handler, d Downloader) (*Result, []byte) {
+	t.Helper()
+	server := httptest.NewServer(handler)
+	t.Cleanup(server.Close)
+	d.URL = server.URL + "/file.bin"
+	d.Client = server.Client()
+	if d.OutputPath == "" {
+		d.OutputPath = filepath.Join(t.TempDir(), "file.bin")
+	}
+	result, err := d.Download(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(d.OutputPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return result, got
+}
+
+// TestDownload checks that the file is downloaded intact from a server with range support in chunks,
+// and from one without range support or without a Content-Length in a single stream
+func TestDownload(t *testing.T) {
+	content := testContent(300000)
+	tests := []struct {
+		name    string
+		handler http.HandlerFunc
+		chunks  int64
+	}{
+		{"ranges", serveContent(content), 8},
+		{"no ranges", serveWithoutRanges(content), 1},
+		{"no Content-Length", serveWithoutLength(content), 1},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			result, got := downloadFrom(t, test.handler, Downloader{Chunks: 8})
+			if !bytes.Equal(got, content) {
+				t.Fatal("downloaded file does not match the content")
+			}
+			if result.Bytes != int64(len(content)) || result.Chunks != test.chunks {
+				t.Fatalf("got %d bytes in %d chunks, want %d bytes in %d chunks", result.Bytes, result.Chunks, len(content), test.chunks)
+			}
+		})
+	}
+}
+
+// TestDownloadTinyFile checks that a 3-byte file asked for in 8 chunks is downloaded in 3, and that every
+// Range request asks for at least one byte
+func TestDownloadTinyFile(t *testing.T) {
+	content := []byte("abc")
+	var mu sync.Mutex
+	var ranges []string
+	result, got := downloadFrom(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if header := r.Header.Get("Range"); header != "" {
+			mu.Lock()
+			ranges = append(ranges, header)
+			mu.Unlock()
+		}
+		serveContent(content)(w, r)
+	}), Downloader{Chunks: 8})
+	if !bytes.Equal(got, content) || result.Chunks != 3 {
+		t.Fatalf("got %q in %d chunks, want %q in 3", got, result.Chunks, content)
+	}
+	if len(ranges) < 3 {
+		t.Fatalf("got %d Range requests, want one for each of the 3 chunks", len(ranges))
+	}
+	for _, header := range ranges {
+		var start, end int64
+		if _, err := fmt.Sscanf(header, "bytes=%d-%d", &start, &end); err != nil || start > end || end >= int64(len(content)) {
+			t.Errorf("invalid Range request %q for a %d-byte file", header, len(content))
+		}
+	}
+}
+
+// TestDownloadEmptyFile checks that an empty file on a server with range support is downloaded as an empty file
+// with the checksum of empty input, without any Range request
+func TestDownloadEmptyFile(t *testing.T) {
+	var ranges []string
+	result, got := downloadFrom(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if header := r.Header.Get("Range"); header != "" {
+			ranges = append(ranges, header)
+		}
+		serveContent(nil)(w, r)
+	}), Downloader{Chunks: 4})
+	if len(got) != 0 || result.Bytes != 0 {
+		t.Fatalf("got %d bytes, %d in the result, want an empty file", len(got), result.Bytes)
+	}
+	if want := sha256.Sum256(nil); !bytes.Equal(result.SHA256, want[:]) {
+		t.Fatalf("got SHA256 %x, want %x", result.SHA256, want)
+	}
+	if len(ranges) != 0 {
+		t.Fatalf("got Range requests %v for an empty file", ranges)
+	}
+}
+
+// TestResumeWithoutRanges checks that with Resume, a .part file left behind for a server without range support,
+// whether shorter or longer than the file, is downloaded again from the start
+func TestResumeWithoutRanges(t *testing.T) {
+	content := testContent(100000)
+	for _, partSize := range []int{50000, 150000} {
+		output := filepath.Join(t.TempDir(), "file.bin")
+		if err := os.WriteFile(output+".part", bytes.Repeat([]byte("x"), partSize), 0o600); err != nil {
+			t.Fatal(err)
+		}
+		_, got := downloadFrom(t, serveWithoutRanges(content), Downloader{OutputPath: output, Resume: true})
+		if !bytes.Equal(got, content) {
+			t.Errorf("with a %d byte .part file, downloaded file does not match the content", partSize)
+		}
+	}
+}
+
+// BenchmarkDownloadBufferSize downloads a 32 MiB file in 10 chunks from an httptest server
+// with read buffers of 8 KiB, the default 64 KiB and 1 MiB
+func BenchmarkDownloadBufferSize(b *testing.B) {
+	content := testContent(32 << 20)
+	server := httptest.NewServer(serveContent(content))
+	defer server.Close()
+	for _, size := range []struct {
+		name string
+		size int
+	}{{"8K", 8 << 10}, {"64K", 64 << 10}, {"1M", 1 << 20}} {
+		b.Run(size.name, func(b *testing.B) {
+			output := filepath.Join(b.TempDir(), "file.bin")
+			b.SetBytes(int64(len(content)))
+			for i := 0; i < b.N; i++ {
+				d := Downloader{URL: server.URL + "/file.bin", Client: server.Client(), OutputPath: output, Overwrite: true,
+					Chunks: 10, BufferSize: size.size, NoChecksum: true}
+				if _, err := d.Download(context.Background()); err != nil {
+					b.Fatal(err)
+				}
+			}
+		})
+	}
+}
+
+// TestInputError checks that an invalid configuration is returned as an *InputError
+func TestInputError(t *testing.T) {
+	for _, d := range []Downloader{{}, {URL: "http://example.com/f", Chunks: -1}, {URL: "http://example.com/f", Stagger: -1}} {
+		_, err := d.Download(context.Background())
+		var inputErr *InputError
+		if !errors.As(err, &inputErr) {
+			t.Errorf("got %v, want an *InputError", err)
+		}
+	}
+}
+
+// TestServerIgnoringRange checks that a server that reports support for HTTP Range requests but answers them
+// with 200 OK and the whole file fails the chunks, instead of every chunk writing the whole file at its offset
+func TestServerIgnoringRange(t *testing.T) {
+	content := testContent(100000)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if r.Method != http.MethodHead {
+			w.Write(content)
+		}
+	}))
+	defer server.Close()
+
+	output := filepath.Join(t.TempDir(), "file.bin")
+	d := Downloader{URL: server.URL + "/file.bin", Client: server.Client(), OutputPath: output, Chunks: 4, Retries: 1}
+	_, err := d.Download(context.Background())
+	var statusErr *StatusError
+	if !errors.As(err, &statusErr) || statusErr.StatusCode != http.StatusOK {
+		t.Fatalf("got %v, want the chunks to fail with the 200 OK status", err)
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Fatalf("output file was created: %v", err)
+	}
+}
+
+// TestProxy checks that with Proxy set, the requests of the default client go through the proxy, which is
+// asked for the absolute URL of a host that does not resolve
+func TestProxy(t *testing.T) {
+	content := testContent(100000)
+	var mu sync.Mutex
+	var requested []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, r.Method+" "+r.URL.String())
+		mu.Unlock()
+		serveContent(content)(w, r)
+	}))
+	defer proxy.Close()
+	proxyURL, err := url.Parse(proxy.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	output := filepath.Join(t.TempDir(), "file.bin")
+	d := Downloader{URL: "http://download.invalid/file.bin", Proxy: proxyURL, OutputPath: output, Chunks: 4}
+	if _, err := d.Download(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("downloaded file does not match the content")
+	}
+	if len(requested) < 5 {
+		t.Fatalf("proxy got %d requests, want the support check and 4 chunks", len(requested))
+	}
+	for _, request := range requested {
+		if !strings.HasSuffix(request, " http://download.invalid/file.bin") {
+			t.Errorf("proxy got %q, want a request for http://download.invalid/file.bin", request)
+		}
+	}
+}
+
+// TestProxyFromEnvironment checks that the requests of a client from NewHTTPClient go through the proxy in
+// HTTP_PROXY, the support check as well as the chunks
+// The environment is only read once per process, so the download runs in a new process of the test binary
+func TestProxyFromEnvironment(t *testing.T) {
+	if output := os.Getenv("TEST_PROXY_OUTPUT"); output != "" {
+		d := Downloader{URL: "http://download.invalid/file.bin", Client: NewHTTPClient(4), OutputPath: output, Chunks: 4}
+		if _, err := d.Download(context.Background()); err != nil {
+			t.Fatal(err)
+		}
+		return
+	}
+	content := testContent(100000)
+	var mu sync.Mutex
+	var requested []string
+	proxy := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		mu.Lock()
+		requested = append(requested, fmt.Sprintf("%s %s %s", r.Method, r.URL, r.Header.Get("Range")))
+		mu.Unlock()
+		serveContent(content)(w, r)
+	}))
+	defer proxy.Close()
+
+	output := filepath.Join(t.TempDir(), "file.bin")
+	t.Setenv("HTTP_PROXY", proxy.URL)
+	t.Setenv("NO_PROXY", "")
+	t.Setenv("TEST_PROXY_OUTPUT", output)
+	child := exec.Command(os.Args[0], "-test.run=^TestProxyFromEnvironment$")
+	if out, err := child.CombinedOutput(); err != nil {
+		t.Fatalf("download through the proxy failed: %v\n%s", err, out)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("downloaded file does not match the content")
+	}
+	var heads, ranges int
+	for _, request := range requested {
+		if !strings.Contains(request, " http://download.invalid/file.bin") {
+			t.Errorf("proxy got %q, want a request for http://download.invalid/file.bin", request)
+		}
+		if strings.HasPrefix(request, http.MethodHead+" ") {
+			heads++
+		} else if strings.HasPrefix(request, http.MethodGet+" ") && strings.Contains(request, "bytes=") {
+			ranges++
+		}
+	}
+	if heads == 0 || ranges < 4 {
+		t.Fatalf("proxy got %v, want the HEAD request and a range GET for each of the 4 chunks", requested)
+	}
+}
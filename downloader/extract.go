@@ -0,0 +1,237 @@
+package downloader
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bufio"
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// maxSymlinkTarget is the maximum length of a symlink target stored as the content of a zip entry
+const maxSymlinkTarget = 4096
+
+// Extract extracts the tar, tar.gz or zip archive at path into dir, which is created if needed, and returns
+// the number of entries extracted
+// The type is detected from the magic bytes, or from the .tar extension for an old tar without them
+// An entry that would be written outside of dir ("zip slip"), by its name or through a symlink, fails the extraction
+// Device files and FIFOs are skipped, and permissions are kept without the setuid, setgid and sticky bits
+func Extract(path string, dir string) (int, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	magic, err := bufio.NewReader(file).Peek(512)
+	if err != nil && err != io.EOF {
+		return 0, err
+	}
+	if _, err := file.Seek(0, io.SeekStart); err != nil {
+		return 0, err
+	}
+	if err := os.MkdirAll(dir, 0777); err != nil {
+		return 0, err
+	}
+	switch {
+	case bytes.HasPrefix(magic, []byte{0x1f, 0x8b}):
+		gz, err := gzip.NewReader(file)
+		if err != nil {
+			return 0, err
+		}
+		defer gz.Close()
+		return extractTar(gz, dir)
+	case bytes.HasPrefix(magic, []byte("PK\x03\x04")) || bytes.HasPrefix(magic, []byte("PK\x05\x06")):
+		info, err := file.Stat()
+		if err != nil {
+			return 0, err
+		}
+		archive, err := zip.NewReader(file, info.Size())
+		if err != nil {
+			return 0, err
+		}
+		return extractZip(archive, dir)
+	case len(magic) > 262 && string(magic[257:262]) == "ustar", strings.HasSuffix(strings.ToLower(path), ".tar"):
+		return extractTar(file, dir)
+	}
+	return 0, fmt.Errorf("%s is not a tar, tar.gz or zip archive", path)
+}
+
+// extractTar extracts the entries of the tar stream r into dir
+func extractTar(r io.Reader, dir string) (int, error) {
+	archive := tar.NewReader(r)
+	extracted := 0
+	for {
+		header, err := archive.Next()
+		if err == io.EOF {
+			return extracted, nil
+		}
+		if err != nil {
+			return extracted, err
+		}
+		target, err := entryPath(dir, header.Name)
+		if err != nil {
+			return extracted, err
+		}
+		mode := header.FileInfo().Mode().Perm()
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0777)
+		case tar.TypeReg, tar.TypeRegA:
+			err = writeEntry(target, archive, mode)
+			if err == nil {
+				err = os.Chtimes(target, header.ModTime, header.ModTime)
+			}
+		case tar.TypeSymlink:
+			err = createSymlink(dir, target, header.Name, header.Linkname)
+		case tar.TypeLink:
+			err = createHardLink(dir, target, header.Linkname)
+		default:
+			continue
+		}
+		if err != nil {
+			return extracted, fmt.Errorf("%s: %w", header.Name, err)
+		}
+		extracted++
+	}
+}
+
+// extractZip extracts the entries of the zip archive into dir
+func extractZip(archive *zip.Reader, dir string) (int, error) {
+	extracted := 0
+	for _, entry := range archive.File {
+		target, err := entryPath(dir, entry.Name)
+		if err != nil {
+			return extracted, err
+		}
+		mode := entry.Mode()
+		if mode.IsDir() {
+			err = os.MkdirAll(target, 0777)
+		} else if mode.IsRegular() || mode&os.ModeSymlink != 0 {
+			err = extractZipEntry(dir, target, entry)
+		} else {
+			continue
+		}
+		if err != nil {
+			return extracted, fmt.Errorf("%s: %w", entry.Name, err)
+		}
+		extracted++
+	}
+	return extracted, nil
+}
+
+// extractZipEntry writes a regular file or a symlink from the zip archive to target
+// A symlink is stored in a zip archive as a file holding its target
+func extractZipEntry(dir string, target string, entry *zip.File) error {
+	content, err := entry.Open()
+	if err != nil {
+		return err
+	}
+	defer content.Close()
+	if entry.Mode()&os.ModeSymlink != 0 {
+		linkname, err := io.ReadAll(io.LimitReader(content, maxSymlinkTarget))
+		if err != nil {
+			return err
+		}
+		return createSymlink(dir, target, entry.Name, string(linkname))
+	}
+	if err := writeEntry(target, content, entry.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(target, entry.Modified, entry.Modified)
+}
+
+// entryPath returns the path in dir of the archive entry name, which must be relative and stay within dir
+func entryPath(dir string, name string) (string, error) {
+	name = filepath.FromSlash(strings.ReplaceAll(name, `\`, "/"))
+	if filepath.IsAbs(name) || filepath.VolumeName(name) != "" || escapesDir(name) {
+		return "", fmt.Errorf("entry %q would be extracted outside of %s", name, dir)
+	}
+	return filepath.Join(dir, name), nil
+}
+
+// escapesDir reports whether the relative path leaves the directory it is relative to once cleaned
+func escapesDir(path string) bool {
+	path = filepath.Clean(path)
+	return path == ".." || strings.HasPrefix(path, ".."+string(filepath.Separator))
+}
+
+// createSymlink creates the symlink at target pointing to linkname, which must be relative and stay within dir
+// Only leading .. elements are allowed in linkname, and they are checked from the real directory of target:
+// as every symlink created so far stays within dir, following them down from a directory within dir stays
+// within it, but a .. after one of them would be resolved from wherever it points to, not from where it seems to be
+func createSymlink(dir string, target string, name string, linkname string) error {
+	elements := strings.Split(filepath.ToSlash(linkname), "/")
+	leading := 0
+	for leading < len(elements) && elements[leading] == ".." {
+		leading++
+	}
+	for _, element := range elements[leading:] {
+		if element == ".." {
+			return fmt.Errorf("symlink %q to %q has a .. after its first elements", name, linkname)
+		}
+	}
+	return replaceEntry(target, func() error {
+		realDir, err := filepath.EvalSymlinks(dir)
+		if err != nil {
+			return err
+		}
+		parent, err := filepath.EvalSymlinks(filepath.Dir(target))
+		if err != nil {
+			return err
+		}
+		relative, err := filepath.Rel(realDir, filepath.Join(parent, linkname))
+		if linkname == "" || filepath.IsAbs(linkname) || err != nil || escapesDir(relative) {
+			return fmt.Errorf("symlink %q to %q points outside of %s", name, linkname, dir)
+		}
+		return os.Symlink(linkname, target)
+	})
+}
+
+// createHardLink creates the hard link at target to the entry linkname extracted before
+// A hard link to a symlink would be a copy of the symlink, resolved from the directory of target, so it is refused
+func createHardLink(dir string, target string, linkname string) error {
+	source, err := entryPath(dir, linkname)
+	if err != nil {
+		return err
+	}
+	if info, err := os.Lstat(source); err != nil {
+		return err
+	} else if !info.Mode().IsRegular() {
+		return fmt.Errorf("hard link to %q, which is not a regular file", linkname)
+	}
+	return replaceEntry(target, func() error { return os.Link(source, target) })
+}
+
+// writeEntry writes the content of a regular file to target with mode, replacing any file or symlink at target
+// so that an existing symlink is never followed
+func writeEntry(target string, content io.Reader, mode os.FileMode) error {
+	return replaceEntry(target, func() error {
+		file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, mode)
+		if err != nil {
+			return err
+		}
+		if _, err := io.Copy(file, content); err != nil {
+			file.Close()
+			return err
+		}
+		return file.Close()
+	})
+}
+
+// replaceEntry creates the parent directories of target and removes any file or symlink at target before create
+func replaceEntry(target string, create func() error) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0777); err != nil {
+		return err
+	}
+	if info, err := os.Lstat(target); err == nil && !info.IsDir() {
+		if err := os.Remove(target); err != nil {
+			return err
+		}
+	}
+	return create()
+}
@@ -0,0 +1,120 @@
+package downloader
+
+import (
+	"encoding/hex"
+	"fmt"
+	"mime"
+	"net/url"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// checksumPlaceholder is replaced once the file is downloaded, the file is saved under the name with it until then
+const checksumPlaceholder = "{sha256-short}"
+
+// placeholderPattern matches the placeholders of a filename template
+var placeholderPattern = regexp.MustCompile(`\{[^{}]*\}`)
+
+// CheckFilenameTemplate returns an error if template holds a placeholder other than {basename}, {ext}, {date},
+// {host} and {sha256-short}
+func CheckFilenameTemplate(template string) error {
+	for _, placeholder := range placeholderPattern.FindAllString(template, -1) {
+		switch placeholder {
+		case "{basename}", "{ext}", "{date}", "{host}", checksumPlaceholder:
+		default:
+			return fmt.Errorf("unknown placeholder %s in filename template %q, use {basename}, {ext}, {date}, {host} or {sha256-short}", placeholder, template)
+		}
+	}
+	return nil
+}
+
+// expandFilename replaces the placeholders of template for the file named filename downloaded from dwLink on date,
+// except for {sha256-short}, which replaceChecksum replaces once the checksum is known
+// A trailing dot is dropped, so that "{basename}.{ext}" does not end with one for a filename without extension
+func expandFilename(template string, filename string, dwLink string, date time.Time) string {
+	ext := filepath.Ext(filename)
+	basename := strings.TrimSuffix(filename, ext)
+	// The extension of a compressed tar archive is kept whole, e.g. tar.gz
+	if strings.HasSuffix(strings.ToLower(basename), ".tar") {
+		basename, ext = basename[:len(basename)-4], basename[len(basename)-4:]+ext
+	}
+	host := ""
+	if parsed, err := url.Parse(dwLink); err == nil {
+		host = parsed.Hostname()
+	}
+	expanded := placeholderPattern.ReplaceAllStringFunc(template, func(placeholder string) string {
+		switch placeholder {
+		case "{basename}":
+			return basename
+		case "{ext}":
+			return strings.TrimPrefix(ext, ".")
+		case "{date}":
+			return date.Format("2006-01-02")
+		case "{host}":
+			return host
+		}
+		return placeholder
+	})
+	return strings.TrimSuffix(expanded, ".")
+}
+
+// contentTypeExtensions are the extensions of common content types, the first is the one appended by addExtension
+// mime.ExtensionsByType lists them alphabetically, e.g. .asc before .txt for text/plain
+var contentTypeExtensions = map[string][]string{
+	"application/gzip":                      {".gz", ".tgz"},
+	"application/x-gzip":                    {".gz", ".tgz"},
+	"application/x-bzip2":                   {".bz2", ".tbz2"},
+	"application/x-xz":                      {".xz", ".txz"},
+	"application/zstd":                      {".zst"},
+	"application/x-tar":                     {".tar"},
+	"application/zip":                       {".zip"},
+	"application/x-7z-compressed":           {".7z"},
+	"application/x-iso9660-image":           {".iso"},
+	"application/vnd.debian.binary-package": {".deb"},
+	"application/x-rpm":                     {".rpm"},
+	"application/pdf":                       {".pdf"},
+	"application/json":                      {".json"},
+	"application/xml":                       {".xml"},
+	"text/xml":                              {".xml"},
+	"text/plain":                            {".txt", ".text", ".log"},
+	"text/csv":                              {".csv"},
+	"text/html":                             {".html", ".htm"},
+	"image/jpeg":                            {".jpg", ".jpeg"},
+	"image/png":                             {".png"},
+	"image/gif":                             {".gif"},
+	"image/webp":                            {".webp"},
+}
+
+// addExtension appends the extension of contentType to filename if it does not already end with one of its extensions,
+// e.g. .gz to "latest" for application/gzip, but not to "latest.tgz"
+// A content type that is not one of contentTypeExtensions only gets an extension if it is the only one mime knows for it,
+// so that application/octet-stream gets none
+func addExtension(filename string, contentType string) string {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil {
+		return filename
+	}
+	known := contentTypeExtensions[mediaType]
+	if extensions, err := mime.ExtensionsByType(mediaType); err == nil {
+		known = append(append([]string(nil), known...), extensions...)
+	}
+	if len(known) == 0 || containsString(known, strings.ToLower(filepath.Ext(filename))) {
+		return filename
+	}
+	if _, ok := contentTypeExtensions[mediaType]; !ok && len(known) > 1 {
+		return filename
+	}
+	return filename + known[0]
+}
+
+// hasChecksumPlaceholder reports whether the file can only be named by template once its checksum is known
+func hasChecksumPlaceholder(template string) bool {
+	return strings.Contains(template, checksumPlaceholder)
+}
+
+// replaceChecksum replaces {sha256-short} in filename with the first 8 hex digits of the SHA256 checksum
+func replaceChecksum(filename string, checksum []byte) string {
+	return strings.ReplaceAll(filename, checksumPlaceholder, hex.EncodeToString(checksum)[:8])
+}
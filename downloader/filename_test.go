@@ -0,0 +1,48 @@
+package downloader
+
+import (
+	"path/filepath"
+	"testing"
+)
+
+// TestResolveFilenameTraversal checks that the filename derived from a URL or a Content-Disposition header
+// never points outside the output directory, whether with encoded slashes or dot-dot segments
+func TestResolveFilenameTraversal(t *testing.T) {
+	tests := []struct {
+		dwLink             string
+		contentDisposition string
+		want               string
+	}{
+		{"http://example.com/files/report.pdf", "", "report.pdf"},
+		{"http://example.com/files/my%20report.pdf", "", "my report.pdf"},
+		// Encoded slashes are decoded into the segment and everything up to the last one is dropped
+		{"http://example.com/download/..%2F..%2Fetc%2Fpasswd", "", "passwd"},
+		{"http://example.com/download/a%2Fb%2Fc.txt", "", "c.txt"},
+		{"http://example.com/download/..%5C..%5Cboot.ini", "", "boot.ini"},
+		{"http://example.com/download/%2E%2E%2F", "", defaultFileName},
+		// Dot-dot segments, encoded or not
+		{"http://example.com/files/..", "", defaultFileName},
+		{"http://example.com/files/.", "", defaultFileName},
+		{"http://example.com/files/%2E%2E", "", defaultFileName},
+		{"http://example.com/files/../../etc/passwd", "", "passwd"},
+		{"http://example.com/", "", defaultFileName},
+		{"http://example.com", "", defaultFileName},
+		{"http://example.com/files/%zz", "", defaultFileName},
+		{"http://example.com/files/nul%00.txt", "", "nul.txt"},
+		// The filename of the server goes through the same checks
+		{"http://example.com/download?id=1", `attachment; filename="../../.ssh/authorized_keys"`, "authorized_keys"},
+		{"http://example.com/download?id=1", `attachment; filename=".."`, defaultFileName},
+		{"http://example.com/download?id=1", `attachment; filename*=UTF-8''..%2F..%2Fevil.sh`, "evil.sh"},
+	}
+	for _, test := range tests {
+		d := Downloader{URL: test.dwLink}
+		remote := &RemoteInfo{FinalURL: test.dwLink, Filename: getContentDispositionFileName(test.contentDisposition)}
+		got := d.resolveFilename(remote)
+		if got != test.want {
+			t.Errorf("resolveFilename(%s, %q) = %q, want %q", test.dwLink, test.contentDisposition, got, test.want)
+		}
+		if filepath.Base(got) != got || got == ".." || got == "." {
+			t.Errorf("resolveFilename(%s, %q) = %q is not a plain filename", test.dwLink, test.contentDisposition, got)
+		}
+	}
+}
@@ -0,0 +1,80 @@
+package downloader
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"log/slog"
+	"strings"
+	"sync"
+)
+
+// LogLevel controls how much a Downloader writes to its Log
+type LogLevel int
+
+const (
+	// LogNormal writes the progress line and a message for every step of the download
+	LogNormal LogLevel = iota
+	// LogQuiet writes nothing, errors are only returned by Download
+	LogQuiet
+	// LogVerbose writes everything LogNormal does, plus every request with its range, status and bytes received
+	LogVerbose
+)
+
+// syncWriter serializes the writes to a Log, so that the messages of the chunks and the progress line
+// never interleave within a line
+type syncWriter struct {
+	mu sync.Mutex
+	w  io.Writer
+}
+
+func (s *syncWriter) Write(p []byte) (int, error) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.w.Write(p)
+}
+
+// println writes a message to the Log, unless LogLevel is LogQuiet
+// With a Logger, the message is logged at slog.LevelInfo instead
+func (d *Downloader) println(a ...interface{}) {
+	if d.Logger != nil {
+		d.Logger.Info(strings.TrimSuffix(fmt.Sprintln(a...), "\n"))
+	} else if d.LogLevel != LogQuiet {
+		fmt.Fprintln(d.Log, a...)
+	}
+}
+
+// debugf writes a message above the progress line if LogLevel is LogVerbose
+// With a Logger, the message is logged at slog.LevelDebug instead
+func (d *Downloader) debugf(format string, a ...interface{}) {
+	if d.Logger != nil {
+		if d.verbose() {
+			d.Logger.Debug(fmt.Sprintf(format, a...))
+		}
+	} else if d.LogLevel == LogVerbose {
+		fmt.Fprintf(d.Log, "\r%-*s\n", progressWidth, fmt.Sprintf(format, a...))
+	}
+}
+
+// warnf writes a message about a failure the download recovers from, e.g. a retried chunk, above the progress line
+// With a Logger, the message is logged at slog.LevelWarn instead
+func (d *Downloader) warnf(format string, a ...interface{}) {
+	if d.Logger != nil {
+		d.Logger.Warn(fmt.Sprintf(format, a...))
+	} else {
+		d.printAboveProgress(fmt.Sprintf(format, a...))
+	}
+}
+
+// verbose reports whether the messages of LogVerbose are written, with a Logger if its handler logs slog.LevelDebug
+func (d *Downloader) verbose() bool {
+	if d.Logger != nil {
+		return d.Logger.Enabled(context.Background(), slog.LevelDebug)
+	}
+	return d.LogLevel == LogVerbose
+}
+
+// printsProgress reports whether the progress line is written to the Log, which it never is with a Logger
+func (d *Downloader) printsProgress() bool {
+	return d.Logger == nil && d.LogLevel != LogQuiet
+}
@@ -0,0 +1,28 @@
+package downloader
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+)
+
+// TestLogConcurrentWrites checks that the messages the chunks write at the same time to a Log that is not safe
+// for concurrent use, a bytes.Buffer, all arrive whole, and under the race detector that the writes do not race
+func TestLogConcurrentWrites(t *testing.T) {
+	var log bytes.Buffer
+	downloadFrom(t, serveContent(testContent(1<<20)), Downloader{Chunks: 16, Log: &log, LogLevel: LogVerbose})
+	lines := strings.Split(log.String(), "\n")
+	for chunk := 1; chunk <= 16; chunk++ {
+		message := fmt.Sprint("Downloaded chunk ", chunk, " successfully!")
+		found := false
+		for _, line := range lines {
+			if strings.TrimSpace(line[strings.LastIndex(line, "\r")+1:]) == message {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("Log has no line %q", message)
+		}
+	}
+}
@@ -0,0 +1,233 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// manifestInterval is how often the manifest of a resumable download is saved
+const manifestInterval = time.Second
+
+// manifest records how far every chunk of a resumable download got, so that it can be resumed even after a crash
+// The .part file is allocated at its full size up front, so its length alone does not tell which bytes are missing
+type manifest struct {
+	// FileSize and ETag identify the remote file, ETag holds the ETag or Last-Modified validator
+	FileSize int64  `json:"file_size"`
+	ETag     string `json:"etag"`
+	// RangeStart and Size are the range of the remote file saved in the .part file
+	RangeStart int64 `json:"range_start"`
+	Size       int64 `json:"size"`
+	// Prefix is the number of bytes at the start of the .part file resumed from a previous run without a manifest
+	Prefix int64           `json:"prefix"`
+	Chunks []manifestChunk `json:"chunks"`
+}
+
+// manifestChunk is the byte range of a chunk in the remote file, and the number of bytes written from its start
+// SHA256 is the hex encoded checksum of a complete chunk as it was on disk, so that a chunk corrupted in the .part file
+// since then can be found with Downloader.ResumeVerify
+type manifestChunk struct {
+	Start   int64  `json:"start"`
+	End     int64  `json:"end"`
+	Written int64  `json:"written"`
+	SHA256  string `json:"sha256,omitempty"`
+}
+
+// manifestPath returns the path of the manifest of the .part file at downloadPath
+func manifestPath(downloadPath string) string {
+	return downloadPath + ".json"
+}
+
+// newManifest returns the manifest of a download of chunks, after prefix bytes resumed from the .part file
+func newManifest(remote *RemoteInfo, rangeStart int64, size int64, prefix int64, chunks []Chunk) *manifest {
+	m := &manifest{FileSize: remote.Size, ETag: remote.validator(), RangeStart: rangeStart, Size: size, Prefix: prefix}
+	for _, chunk := range chunks {
+		m.Chunks = append(m.Chunks, manifestChunk{Start: chunk.Start, End: chunk.End})
+	}
+	return m
+}
+
+// loadManifest reads the manifest at path, and checks that it is consistent
+func loadManifest(path string) (*manifest, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var m manifest
+	if err := json.Unmarshal(data, &m); err != nil {
+		return nil, fmt.Errorf("%s is not a valid manifest: %w", path, err)
+	}
+	for _, chunk := range m.Chunks {
+		if chunk.Start > chunk.End || chunk.Written < 0 || chunk.Written > chunk.End-chunk.Start+1 {
+			return nil, fmt.Errorf("%s is not a valid manifest: invalid chunk %d-%d with %d bytes written", path, chunk.Start, chunk.End, chunk.Written)
+		}
+	}
+	return &m, nil
+}
+
+// loadResumeManifest returns the manifest of the .part file at downloadPath if it is for the same remote file and range
+// found reports whether there is a manifest at all, the .part file must then not be resumed from its length either
+func loadResumeManifest(downloadPath string, remote *RemoteInfo, rangeStart int64, size int64, partSize int64) (m *manifest, found bool) {
+	m, err := loadManifest(manifestPath(downloadPath))
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, false
+	}
+	if err != nil || m.FileSize != remote.Size || m.ETag != remote.validator() || m.RangeStart != rangeStart || m.Size != size || partSize != size {
+		return nil, true
+	}
+	return m, true
+}
+
+// save writes the manifest to a temporary file that is renamed to path, so that a crash never leaves half a manifest
+func (m *manifest) save(path string) error {
+	data, err := json.Marshal(m)
+	if err != nil {
+		return err
+	}
+	if err := os.WriteFile(path+".tmp", data, 0666); err != nil {
+		return err
+	}
+	return os.Rename(path+".tmp", path)
+}
+
+// completed returns the number of bytes of the .part file that have been downloaded
+func (m *manifest) completed() int64 {
+	completed := m.Prefix
+	for _, chunk := range m.Chunks {
+		completed += chunk.Written
+	}
+	return completed
+}
+
+// remaining returns the parts of the chunks that still need to be downloaded, indexed like Chunks
+func (m *manifest) remaining() []Chunk {
+	var chunks []Chunk
+	for i, chunk := range m.Chunks {
+		if start := chunk.Start + chunk.Written; start <= chunk.End {
+			chunks = append(chunks, Chunk{Index: int64(i), Start: start, End: chunk.End})
+		}
+	}
+	return chunks
+}
+
+// offsets returns the offsets up to which every chunk has been written, to be updated by downloadChunks
+func (m *manifest) offsets() []int64 {
+	offsets := make([]int64, len(m.Chunks))
+	for i, chunk := range m.Chunks {
+		offsets[i] = chunk.Start + chunk.Written
+	}
+	return offsets
+}
+
+// checkpoint saves the manifest with the bytes written up to offsets after syncing file, so that the manifest
+// never records bytes that are not on disk yet
+// The chunks completed since the last checkpoint are read back from file to save their checksums
+func (m *manifest) checkpoint(path string, file *os.File, offsets []int64) error {
+	// The offsets are read before syncing, bytes written after that may not have been synced
+	written := make([]int64, len(offsets))
+	for i := range offsets {
+		written[i] = atomic.LoadInt64(&offsets[i]) - m.Chunks[i].Start
+	}
+	if err := file.Sync(); err != nil {
+		return err
+	}
+	checksums := make([]string, len(m.Chunks))
+	for i, chunk := range m.Chunks {
+		checksums[i] = chunk.SHA256
+		if checksums[i] == "" && written[i] == chunk.End-chunk.Start+1 {
+			checksum, err := m.chunkChecksum(file, chunk)
+			if err != nil {
+				return err
+			}
+			checksums[i] = checksum
+		}
+	}
+	for i := range m.Chunks {
+		m.Chunks[i].Written = written[i]
+		m.Chunks[i].SHA256 = checksums[i]
+	}
+	return m.save(path)
+}
+
+// chunkChecksum returns the hex encoded SHA256 checksum of chunk as it is in the .part file
+func (m *manifest) chunkChecksum(file io.ReaderAt, chunk manifestChunk) (string, error) {
+	h := sha256.New()
+	if _, err := io.Copy(h, io.NewSectionReader(file, chunk.Start-m.RangeStart, chunk.End-chunk.Start+1)); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// verify reads every complete chunk with a checksum back from file, and marks those that do not match it anymore
+// as not written at all, so that they are downloaded again
+// It returns the number of chunks that were verified, the number of them that were corrupt, and the number of
+// complete chunks without a checksum, which cannot be verified
+func (m *manifest) verify(file io.ReaderAt) (verified int, corrupt int, unverified int, err error) {
+	for i, chunk := range m.Chunks {
+		if chunk.Written != chunk.End-chunk.Start+1 {
+			continue
+		}
+		if chunk.SHA256 == "" {
+			unverified++
+			continue
+		}
+		checksum, err := m.chunkChecksum(file, chunk)
+		if err != nil {
+			return verified, corrupt, unverified, err
+		}
+		verified++
+		if checksum != chunk.SHA256 {
+			corrupt++
+			m.Chunks[i].Written = 0
+			m.Chunks[i].SHA256 = ""
+		}
+	}
+	return verified, corrupt, unverified, nil
+}
+
+// verifyResume verifies the complete chunks of the .part file at downloadPath against the checksums in m,
+// and returns the number of corrupt chunks, which are downloaded again
+func (d *Downloader) verifyResume(m *manifest, downloadPath string) (int, error) {
+	file, err := os.Open(downloadPath)
+	if err != nil {
+		return 0, err
+	}
+	defer file.Close()
+	d.println("Verifying the completed chunks of ", downloadPath, "...")
+	verified, corrupt, unverified, err := m.verify(file)
+	if err != nil {
+		return 0, fmt.Errorf("Fatal error in verifying %s: %w", downloadPath, err)
+	}
+	if unverified > 0 {
+		d.println(unverified, "completed chunk(s) have no checksum in the manifest and cannot be verified")
+	}
+	if corrupt > 0 {
+		d.println("Found ", corrupt, " corrupt chunk(s) of ", verified, " verified, downloading them again")
+	} else {
+		d.println("Verified ", verified, " completed chunk(s), none are corrupt")
+	}
+	return corrupt, nil
+}
+
+// saveManifest checkpoints the manifest every manifestInterval until done is closed, stopped is closed once it returns
+func (d *Downloader) saveManifest(m *manifest, path string, file *os.File, offsets []int64, done <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+	ticker := time.NewTicker(manifestInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			if err := m.checkpoint(path, file, offsets); err != nil {
+				d.debugf("Could not save %s: %s", path, err)
+			}
+		}
+	}
+}
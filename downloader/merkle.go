@@ -0,0 +1,159 @@
+package downloader
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"hash"
+	"io"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// The Merkle root is the Merkle Tree Hash of RFC 6962 (section 2.1) over the chunks of the file, in order:
+// a leaf is SHA256(0x00 || chunk bytes), a node is SHA256(0x01 || left || right), and a list of n > 1 leaves
+// is split after the largest power of two smaller than n, the root of no leaves is SHA256 of nothing
+// The chunks are those of a fresh download, ComputeChunks(size, chunks), so the root only depends on the bytes
+// and the number of chunks, not on resuming, retries or mirrors
+
+// merkleTree hashes the chunks of a download while they are written, as the leaves of the Merkle tree
+type merkleTree struct {
+	leaves []*merkleLeaf
+}
+
+// merkleLeaf is the hash of a chunk, fed with its bytes in order
+type merkleLeaf struct {
+	mu    sync.Mutex
+	chunk Chunk
+	h     hash.Hash
+	// next is the offset of the next byte to hash, if bytes are written anywhere else, e.g. when resuming
+	// from the middle of the chunk, broken is set and the chunk is read back from the file instead
+	next   int64
+	broken bool
+}
+
+// newMerkleTree returns the tree of a file of size bytes split into numChunks chunks, offsets are relative to its start
+func newMerkleTree(size int64, numChunks int64) *merkleTree {
+	t := &merkleTree{}
+	for _, chunk := range ComputeChunks(size, numChunks) {
+		t.leaves = append(t.leaves, &merkleLeaf{chunk: chunk, h: newLeafHash(), next: chunk.Start})
+	}
+	return t
+}
+
+// newLeafHash returns the hash of a leaf, to be fed with the bytes of its chunk
+func newLeafHash() hash.Hash {
+	h := sha256.New()
+	h.Write([]byte{0x00})
+	return h
+}
+
+// write hashes the bytes written at off, which may span several chunks
+func (t *merkleTree) write(p []byte, off int64) {
+	for len(p) > 0 {
+		i := sort.Search(len(t.leaves), func(i int) bool { return t.leaves[i].chunk.End >= off })
+		if i == len(t.leaves) {
+			return
+		}
+		leaf := t.leaves[i]
+		n := int64(len(p))
+		if rest := leaf.chunk.End - off + 1; n > rest {
+			n = rest
+		}
+		leaf.mu.Lock()
+		if !leaf.broken && off == leaf.next {
+			leaf.h.Write(p[:n])
+			leaf.next += n
+		} else {
+			leaf.broken = true
+		}
+		leaf.mu.Unlock()
+		p, off = p[n:], off+n
+	}
+}
+
+// complete reports whether every chunk has been hashed while it was written
+func (t *merkleTree) complete() bool {
+	for _, leaf := range t.leaves {
+		if leaf.broken || leaf.next != leaf.chunk.End+1 {
+			return false
+		}
+	}
+	return true
+}
+
+// merkleRoot returns the Merkle root of the tree, the chunks that were not hashed while they were written
+// are read back from r, which may be nil if the tree is complete
+func (d *Downloader) merkleRoot(t *merkleTree, r io.ReaderAt) ([]byte, error) {
+	sums := make([][]byte, len(t.leaves))
+	var readBack int
+	for i, leaf := range t.leaves {
+		if !leaf.broken && leaf.next == leaf.chunk.End+1 {
+			sums[i] = leaf.h.Sum(nil)
+			continue
+		}
+		if r == nil {
+			return nil, fmt.Errorf("chunk %d was not hashed while downloading and cannot be read back", i+1)
+		}
+		h := newLeafHash()
+		if _, err := io.Copy(h, io.NewSectionReader(r, leaf.chunk.Start, leaf.chunk.End-leaf.chunk.Start+1)); err != nil {
+			return nil, err
+		}
+		sums[i] = h.Sum(nil)
+		readBack++
+	}
+	if readBack > 0 {
+		d.println("Read back ", readBack, " of ", len(t.leaves), " chunks that were not hashed while downloading")
+	}
+	return merkleTreeHash(sums), nil
+}
+
+// singleLeafRoot returns the Merkle root of a single stream download of downloaded bytes hashed by leaf,
+// and its number of leaves, which is 0 for an empty file
+func singleLeafRoot(leaf hash.Hash, downloaded int64) ([]byte, int64) {
+	if downloaded == 0 {
+		return merkleTreeHash(nil), 0
+	}
+	return merkleTreeHash([][]byte{leaf.Sum(nil)}), 1
+}
+
+// merkleTreeHash returns the root of the leaf hashes, as in RFC 6962
+func merkleTreeHash(leaves [][]byte) []byte {
+	switch len(leaves) {
+	case 0:
+		sum := sha256.Sum256(nil)
+		return sum[:]
+	case 1:
+		return leaves[0]
+	}
+	split := 1
+	for split*2 < len(leaves) {
+		split *= 2
+	}
+	h := sha256.New()
+	h.Write([]byte{0x01})
+	h.Write(merkleTreeHash(leaves[:split]))
+	h.Write(merkleTreeHash(leaves[split:]))
+	return h.Sum(nil)
+}
+
+// merkleWriter hashes the bytes written to w into the Merkle tree
+type merkleWriter struct {
+	w    io.WriterAt
+	tree *merkleTree
+}
+
+func (m *merkleWriter) WriteAt(p []byte, off int64) (int, error) {
+	n, err := m.w.WriteAt(p, off)
+	m.tree.write(p[:n], off)
+	return n, err
+}
+
+// verifyMerkleRoot compares the Merkle root to the expected hex encoded one, case-insensitively
+func verifyMerkleRoot(root []byte, expected string) error {
+	if got := hex.EncodeToString(root); expected != "" && !strings.EqualFold(got, expected) {
+		return &ChecksumError{Algorithm: "Merkle root", Expected: strings.ToLower(expected), Actual: got}
+	}
+	return nil
+}
@@ -0,0 +1,28 @@
+package downloader
+
+import "time"
+
+// Metrics receives the measurements of every download, e.g. to export them to Prometheus from a long-running service
+// Its methods are called concurrently by the chunks, so they must be safe for concurrent use and must not block
+type Metrics interface {
+	// AddBytes is called with the bytes received from host, as they are written
+	AddBytes(host string, n int)
+	// ChunkStarted is called when a chunk starts downloading, and ChunkDone once it is done, successfully or not,
+	// a single stream download is a single chunk
+	ChunkStarted()
+	ChunkDone()
+	// ChunkRetried is called for every retry of a chunk, and for every failed chunk downloaded again in another pass
+	ChunkRetried()
+	// DownloadDone is called once a download is done, with how long it took and its error, nil if it succeeded
+	// It is not called for DryRun, or if the Downloader is invalid
+	DownloadDone(elapsed time.Duration, err error)
+}
+
+// noMetrics is the Metrics of a Downloader without them
+type noMetrics struct{}
+
+func (noMetrics) AddBytes(host string, n int)                   {}
+func (noMetrics) ChunkStarted()                                 {}
+func (noMetrics) ChunkDone()                                    {}
+func (noMetrics) ChunkRetried()                                 {}
+func (noMetrics) DownloadDone(elapsed time.Duration, err error) {}
@@ -0,0 +1,218 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"sync/atomic"
+)
+
+// errUnrequestedBytes is returned for a part of a multi-range response that does not continue one of the requested chunks
+var errUnrequestedBytes = errors.New("Server Error: multi-range response holds bytes that were not requested")
+
+// downloadBatches downloads chunks with up to d.RangesPerRequest of them in a single multi-range request,
+// so that many small chunks do not cost a request each, and writes the parts of the multipart/byteranges responses
+// at the offsets of their chunks
+// It returns the parts of the chunks that were not downloaded, to be downloaded one per request by downloadChunksOnce,
+// which retries them: those of a request that failed, and those of every request once a server answered with
+// 200 OK as it does not support multi-range requests, after which no further multi-range request is made
+// If offsets is not nil, offsets[chunk.Index] is kept at the offset up to which every chunk has been written
+func (d *Downloader) downloadBatches(ctx context.Context, dwLinks []string, file io.WriterAt, chunks []Chunk, fileSize int64, downloaded *int64, offsets []int64) []Chunk {
+	var wg sync.WaitGroup
+	var mu sync.Mutex
+	var remaining []Chunk
+	var unsupported int32
+	tokens := make(chan struct{}, d.MaxConcurrent)
+	for i := 0; i*d.RangesPerRequest < len(chunks); i++ {
+		end := (i + 1) * d.RangesPerRequest
+		if end > len(chunks) {
+			end = len(chunks)
+		}
+		batch := chunks[i*d.RangesPerRequest : end]
+		wg.Add(1)
+		go func(batch []Chunk, dwLink string) {
+			defer wg.Done()
+			left := batch
+			select {
+			case <-ctx.Done():
+			case tokens <- struct{}{}:
+				if atomic.LoadInt32(&unsupported) == 0 {
+					var multiRange bool
+					left, multiRange = d.downloadBatch(ctx, dwLink, file, batch, fileSize, downloaded, offsets)
+					if !multiRange && atomic.CompareAndSwapInt32(&unsupported, 0, 1) {
+						d.printAboveProgress("Server does not support multi-range requests, requesting one range at a time")
+					}
+				}
+				<-tokens
+			}
+			mu.Lock()
+			remaining = append(remaining, left...)
+			mu.Unlock()
+		}(batch, dwLinks[i%len(dwLinks)])
+	}
+	wg.Wait()
+	// The batches finish in any order, the chunks are started in the order of the file again
+	sort.Slice(remaining, func(i, j int) bool { return remaining[i].Start < remaining[j].Start })
+	return remaining
+}
+
+// downloadBatch requests all chunks of batch from dwLink in a single multi-range request and writes the parts
+// of the response, it returns the parts of the chunks that were not downloaded
+// multiRange is false if the server answered with 200 OK instead, as it does not support multi-range requests
+func (d *Downloader) downloadBatch(ctx context.Context, dwLink string, file io.WriterAt, batch []Chunk, fileSize int64, downloaded *int64, offsets []int64) (remaining []Chunk, multiRange bool) {
+	// next holds the offset of the next byte of every chunk of the batch
+	next := make([]int64, len(batch))
+	ranges := make([]string, len(batch))
+	for i, chunk := range batch {
+		next[i] = chunk.Start
+		ranges[i] = fmt.Sprintf("%d-%d", chunk.Start, chunk.End)
+	}
+	defer func() {
+		for i, chunk := range batch {
+			if next[i] <= chunk.End {
+				remaining = append(remaining, Chunk{Index: chunk.Index, Start: next[i], End: chunk.End})
+			} else {
+				d.printAboveProgress(fmt.Sprint("Downloaded chunk ", chunk.Index+1, " successfully!"))
+			}
+		}
+	}()
+	craftRequest, err := d.newRequest(ctx, "GET", dwLink)
+	if err != nil {
+		return nil, true
+	}
+	rangeHeader := "bytes=" + strings.Join(ranges, ",")
+	craftRequest.Header.Set("Range", rangeHeader)
+	if validator := d.validators[dwLink]; validator != "" {
+		craftRequest.Header.Set("If-Range", validator)
+	}
+	d.Metrics.ChunkStarted()
+	defer d.Metrics.ChunkDone()
+	response, err := d.Client.Do(craftRequest)
+	if err != nil {
+		d.debugf("GET %s %s failed: %s", dwLink, rangeHeader, err)
+		return nil, true
+	}
+	defer response.Body.Close()
+	d.debugf("GET %s %s: %s %s, %s", dwLink, rangeHeader, response.Proto, response.Status, response.Header.Get("Content-Type"))
+	if response.StatusCode == http.StatusOK {
+		return nil, false
+	}
+	if response.StatusCode != http.StatusPartialContent {
+		return nil, true
+	}
+	watchdog := d.watchStalls(response.Body)
+	defer watchdog.stop()
+	boundary, ok := byteRangesBoundary(response.Header)
+	if !ok {
+		// A server may coalesce adjacent ranges into a single one, answered like a single range request
+		err = d.writeBatchPart(ctx, response.Body, response.Header.Get("Content-Range"), response.Request.URL.Host, watchdog, file, batch, next, fileSize, downloaded, offsets)
+	} else {
+		parts := multipart.NewReader(response.Body, boundary)
+		for err == nil {
+			var part *multipart.Part
+			watchdog.start()
+			part, err = parts.NextPart()
+			watchdog.stop()
+			if errors.Is(err, io.EOF) {
+				err = nil
+				break
+			}
+			if err != nil {
+				err = fmt.Errorf("Server Error: invalid multipart/byteranges response: %w", err)
+				break
+			}
+			err = d.writeBatchPart(ctx, part, part.Header.Get("Content-Range"), response.Request.URL.Host, watchdog, file, batch, next, fileSize, downloaded, offsets)
+		}
+	}
+	if watchdogErr := watchdog.err(); watchdogErr != nil {
+		err = watchdogErr
+	}
+	if err != nil {
+		d.debugf("GET %s %s: %s", dwLink, rangeHeader, err)
+	}
+	return nil, true
+}
+
+// writeBatchPart writes the bytes of the part of a multi-range response with contentRange to file,
+// the part must start at the next byte of one of the chunks of batch, and may continue into the following chunks
+// if they are adjacent, next is updated with every write, host is where the bytes come from for d.Metrics
+func (d *Downloader) writeBatchPart(ctx context.Context, part io.Reader, contentRange string, host string, watchdog *stallWatchdog, file io.WriterAt, batch []Chunk, next []int64, fileSize int64, downloaded *int64, offsets []int64) error {
+	first, last, total, err := parseContentRange(contentRange)
+	if err != nil {
+		return err
+	}
+	if err := checkTotal(total, fileSize); err != nil {
+		return err
+	}
+	current := -1
+	for i, chunk := range batch {
+		if chunk.Start <= first && first <= chunk.End && first == next[i] {
+			current = i
+		}
+	}
+	if current == -1 || last < first {
+		return errUnrequestedBytes
+	}
+	offset := first
+	pooled := d.buffers.Get().(*[]byte)
+	defer d.buffers.Put(pooled)
+	buff := *pooled
+	for {
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		watchdog.start()
+		bytesRead, readErr := part.Read(buff)
+		watchdog.stop()
+		if d.limiter != nil && bytesRead > 0 {
+			if err := d.limiter.wait(ctx, bytesRead); err != nil {
+				return err
+			}
+		}
+		if offset+int64(bytesRead) > last+1 {
+			return fmt.Errorf("Server Error: the part for bytes %d-%d is longer than its Content-Range", first, last)
+		}
+		p := buff[:bytesRead]
+		for len(p) > 0 {
+			chunk := batch[current]
+			if offset > chunk.End {
+				// Only a chunk that starts right after this one and has nothing written yet can be continued
+				current++
+				if current == len(batch) || batch[current].Start != offset || next[current] != offset {
+					return errUnrequestedBytes
+				}
+				continue
+			}
+			n := int64(len(p))
+			if n > chunk.End-offset+1 {
+				n = chunk.End - offset + 1
+			}
+			written, err := file.WriteAt(p[:n], offset)
+			offset += int64(written)
+			next[current] = offset
+			atomic.AddInt64(downloaded, int64(written))
+			d.Metrics.AddBytes(host, written)
+			if offsets != nil {
+				atomic.StoreInt64(&offsets[chunk.Index], offset)
+			}
+			if err != nil {
+				return fmt.Errorf("Error during WRITE: %s", err.Error())
+			}
+			p = p[n:]
+		}
+		if errors.Is(readErr, io.EOF) {
+			if offset != last+1 {
+				return fmt.Errorf("Error during READ, reached EOF after %d of %d bytes of the part", offset-first, last-first+1)
+			}
+			return nil
+		} else if readErr != nil {
+			return fmt.Errorf("Error during READ: %w", readErr)
+		}
+	}
+}
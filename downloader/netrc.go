@@ -0,0 +1,108 @@
+package downloader
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+)
+
+// netrcEntry holds the credentials of a machine entry of a netrc file, or of the default entry if machine is ""
+type netrcEntry struct {
+	machine  string
+	login    string
+	password string
+}
+
+// readNetrc parses the netrc file at path
+func readNetrc(path string) ([]netrcEntry, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries, err := parseNetrc(file)
+	if err != nil {
+		return nil, fmt.Errorf("%s: %w", path, err)
+	}
+	return entries, nil
+}
+
+// parseNetrc parses the machine, default, login and password tokens of a netrc file
+// The account token is skipped with its value, and so are macdef macros, which end at the next empty line
+func parseNetrc(r io.Reader) ([]netrcEntry, error) {
+	var entries []netrcEntry
+	var current *netrcEntry
+	// key is the token whose value is expected next
+	key := ""
+	inMacro := false
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		if inMacro {
+			inMacro = strings.TrimSpace(scanner.Text()) != ""
+			continue
+		}
+		for _, token := range strings.Fields(scanner.Text()) {
+			if key != "" {
+				switch key {
+				case "machine":
+					entries = append(entries, netrcEntry{machine: token})
+					current = &entries[len(entries)-1]
+				case "login":
+					current.login = token
+				case "password":
+					current.password = token
+				}
+				// The lines after the name of a macro are its body
+				inMacro = key == "macdef"
+				key = ""
+				if inMacro {
+					break
+				}
+				continue
+			}
+			if strings.HasPrefix(token, "#") {
+				break
+			}
+			switch token {
+			case "machine", "account", "macdef":
+				key = token
+			case "login", "password":
+				if current == nil {
+					return nil, fmt.Errorf("line %d: %s before the first machine or default entry", line, token)
+				}
+				key = token
+			case "default":
+				entries = append(entries, netrcEntry{})
+				current = &entries[len(entries)-1]
+			default:
+				return nil, fmt.Errorf("line %d: unknown token %q", line, token)
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	if key != "" {
+		return nil, fmt.Errorf("missing value after %s", key)
+	}
+	return entries, nil
+}
+
+// lookupNetrc returns the entry of the first machine named host, or the default entry if there is none
+func lookupNetrc(entries []netrcEntry, host string) (netrcEntry, bool) {
+	var fallback *netrcEntry
+	for i, entry := range entries {
+		if entry.machine == host {
+			return entry, true
+		}
+		if entry.machine == "" && fallback == nil {
+			fallback = &entries[i]
+		}
+	}
+	if fallback != nil {
+		return *fallback, true
+	}
+	return netrcEntry{}, false
+}
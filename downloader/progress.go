@@ -0,0 +1,158 @@
+package downloader
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// progressInterval is how often printProgress refreshes the progress line
+const progressInterval = 500 * time.Millisecond
+
+// speedWindow is the number of progress intervals the speed and ETA are averaged over
+const speedWindow = 10
+
+// throughputBarWidth is the width of the longest bar of the histogram written to ThroughputLog
+const throughputBarWidth = 40
+
+// progressWidth is the width the progress line is padded to, so that shorter lines fully overwrite it
+const progressWidth = 72
+
+// printAboveProgress prints a message on its own line, overwriting the current progress line
+// The progress line is printed again below it on the next tick of printProgress
+// With a Logger, the message is logged at slog.LevelInfo instead
+func (d *Downloader) printAboveProgress(message string) {
+	if d.Logger != nil {
+		d.Logger.Info(message)
+		return
+	}
+	if d.LogLevel == LogQuiet {
+		return
+	}
+	fmt.Fprintf(d.Log, "\r%-*s\n", progressWidth, message)
+}
+
+// printProgress prints the aggregate progress of the download every progressInterval until done is closed
+// downloaded is the shared counter updated atomically by the goroutines writing the file, fileSize is 0 when unknown
+// stopped is closed once the final progress line has been printed
+// ProgressFunc is called from here on every tick too, so it is never called concurrently
+// The bytes downloaded every second are recorded here as well, and written to ThroughputLog once done is closed
+func (d *Downloader) printProgress(downloaded *int64, fileSize int64, done <-chan struct{}, stopped chan<- struct{}) {
+	defer close(stopped)
+	if !d.printsProgress() && d.ProgressFunc == nil && d.ThroughputLog == nil {
+		<-done
+		return
+	}
+	ticker := time.NewTicker(progressInterval)
+	defer ticker.Stop()
+
+	// The speed is measured over the last speedWindow intervals, so the ETA does not jump with every tick
+	samples := []progressSample{{time.Now(), atomic.LoadInt64(downloaded)}}
+	var speed float64
+	// seconds holds the bytes downloaded at the start and at the end of every second so far
+	seconds := []progressSample{samples[0]}
+	const ticksPerSecond = int(time.Second / progressInterval)
+	for ticks := 1; ; ticks++ {
+		select {
+		case <-done:
+			currBytes := atomic.LoadInt64(downloaded)
+			if d.ProgressFunc != nil {
+				d.ProgressFunc(currBytes, fileSize)
+			}
+			if d.printsProgress() {
+				fmt.Fprintf(d.Log, "\r%-*s\n", progressWidth, formatProgress(currBytes, fileSize, speed))
+			}
+			if d.ThroughputLog != nil {
+				// The last, partial second is only dropped if there are no bytes in it
+				if currBytes > seconds[len(seconds)-1].bytes || len(seconds) == 1 {
+					seconds = append(seconds, progressSample{time.Now(), currBytes})
+				}
+				writeThroughputLog(d.ThroughputLog, seconds)
+			}
+			return
+		case now := <-ticker.C:
+			currBytes := atomic.LoadInt64(downloaded)
+			samples = append(samples, progressSample{now, currBytes})
+			if len(samples) > speedWindow+1 {
+				samples = samples[1:]
+			}
+			first := samples[0]
+			speed = float64(currBytes-first.bytes) / now.Sub(first.time).Seconds()
+			if ticks%ticksPerSecond == 0 {
+				seconds = append(seconds, progressSample{now, currBytes})
+			}
+			if d.ProgressFunc != nil {
+				d.ProgressFunc(currBytes, fileSize)
+			}
+			if d.printsProgress() {
+				fmt.Fprintf(d.Log, "\r%-*s", progressWidth, formatProgress(currBytes, fileSize, speed))
+			}
+		}
+	}
+}
+
+// writeThroughputLog writes the rate between every two seconds as a histogram, one line per second with a bar
+// scaled to the fastest second, so that stalls, the ramp-up and the steady rate can be told apart at a glance
+// The last line is the last, partial second, labeled with the time the download ended
+func writeThroughputLog(w io.Writer, seconds []progressSample) {
+	rates := make([]float64, len(seconds)-1)
+	var max float64
+	for i := range rates {
+		rates[i] = float64(seconds[i+1].bytes-seconds[i].bytes) / seconds[i+1].time.Sub(seconds[i].time).Seconds()
+		if rates[i] > max {
+			max = rates[i]
+		}
+	}
+	fmt.Fprintln(w, "Throughput per second:")
+	for i, rate := range rates {
+		bar := 0
+		if max > 0 {
+			bar = int(rate * throughputBarWidth / max)
+		}
+		elapsed := seconds[i+1].time.Sub(seconds[0].time).Seconds()
+		fmt.Fprintf(w, "%6.1fs |%-*s| %s/s\n", elapsed, throughputBarWidth, strings.Repeat("#", bar), FormatBytes(int64(rate)))
+	}
+}
+
+// progressSample is the number of bytes downloaded at a point in time
+type progressSample struct {
+	time  time.Time
+	bytes int64
+}
+
+// formatProgress returns the progress line for the given number of bytes downloaded and speed in bytes per second
+// The ETA is only shown when the file size is known and bytes are arriving
+func formatProgress(currBytes int64, fileSize int64, speed float64) string {
+	if fileSize <= 0 {
+		return fmt.Sprintf("Progress: %s at %s/s", FormatBytes(currBytes), FormatBytes(int64(speed)))
+	}
+	percentage := float64(currBytes) * 100 / float64(fileSize)
+	line := fmt.Sprintf("Progress: %s / %s (%.1f%%) at %s/s", FormatBytes(currBytes), FormatBytes(fileSize), percentage, FormatBytes(int64(speed)))
+	if speed > 0 && currBytes < fileSize {
+		eta := time.Duration(float64(fileSize-currBytes) / speed * float64(time.Second))
+		line += fmt.Sprint(", ETA ", eta.Round(time.Second))
+	}
+	return line
+}
+
+// FormatBytes formats a number of bytes with binary (1024) based units, e.g. "512 B", "1.5 KB" or "1.2 GB"
+func FormatBytes(bytes int64) string {
+	const unit = 1024
+	if bytes < unit {
+		return fmt.Sprintf("%d B", bytes)
+	}
+	div, exp := int64(unit), 0
+	for n := bytes / unit; n >= unit && exp < len("KMGTPE")-1; n /= unit {
+		div *= unit
+		exp++
+	}
+	value := float64(bytes) / float64(div)
+	// A value just below the next unit would be rounded up to "1024.0", so it is shown in the next unit
+	if value >= unit-0.05 && exp < len("KMGTPE")-1 {
+		value /= unit
+		exp++
+	}
+	return fmt.Sprintf("%.1f %cB", value, "KMGTPE"[exp])
+}
@@ -0,0 +1,36 @@
+package downloader
+
+import "testing"
+
+func TestFormatBytes(t *testing.T) {
+	tests := []struct {
+		bytes int64
+		want  string
+	}{
+		{0, "0 B"},
+		{1, "1 B"},
+		{1023, "1023 B"},
+		{1024, "1.0 KB"},
+		{1025, "1.0 KB"},
+		{1536, "1.5 KB"},
+		{1<<20 - 52, "1023.9 KB"},
+		// Rounded to one decimal these would be 1024.0 of the smaller unit
+		{1<<20 - 51, "1.0 MB"},
+		{1<<20 - 1, "1.0 MB"},
+		{1 << 20, "1.0 MB"},
+		{1<<20 + 1, "1.0 MB"},
+		{1<<30 - 1, "1.0 GB"},
+		{1 << 30, "1.0 GB"},
+		{1<<30 + 1<<29, "1.5 GB"},
+		{1<<40 - 1, "1.0 TB"},
+		{1 << 40, "1.0 TB"},
+		{1 << 60, "1.0 EB"},
+		// There is no unit after EB
+		{1<<63 - 1, "8.0 EB"},
+	}
+	for _, test := range tests {
+		if got := FormatBytes(test.bytes); got != test.want {
+			t.Errorf("FormatBytes(%d) = %q, want %q", test.bytes, got, test.want)
+		}
+	}
+}
@@ -0,0 +1,88 @@
+package downloader
+
+import (
+	"context"
+	"sync"
+	"time"
+)
+
+// rateLimiter is a token bucket shared by all chunks, so that together they stay under the rate
+// Reads are never split, a read that takes more tokens than are available waits until they are refilled
+type rateLimiter struct {
+	mu sync.Mutex
+	// rate is the number of tokens, i.e. bytes, added per second
+	rate float64
+	// burst is the maximum number of tokens the bucket holds
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+// newRateLimiter returns a limiter for bytesPerSec, allowing bursts of a tenth of a second
+func newRateLimiter(bytesPerSec int64) *rateLimiter {
+	burst := float64(bytesPerSec) / 10
+	if burst < 1 {
+		burst = 1
+	}
+	return &rateLimiter{rate: float64(bytesPerSec), burst: burst, last: time.Now()}
+}
+
+// wait takes n tokens from the bucket, waiting until the bucket is refilled if that leaves it in debt
+// Waiting is cut short when ctx is canceled
+func (l *rateLimiter) wait(ctx context.Context, n int) error {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	delay := time.Duration(-l.tokens / l.rate * float64(time.Second))
+	l.mu.Unlock()
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
+
+// staggerGate spaces out the starts of the chunk requests by at least interval, a nil gate does not wait
+type staggerGate struct {
+	mu       sync.Mutex
+	interval time.Duration
+	// next is the earliest time the next request can start
+	next time.Time
+}
+
+// wait blocks until interval has passed since the start of the previous request, or ctx is canceled
+func (g *staggerGate) wait(ctx context.Context) error {
+	if g == nil {
+		return nil
+	}
+	g.mu.Lock()
+	start := time.Now()
+	if g.next.After(start) {
+		start = g.next
+	}
+	g.next = start.Add(g.interval)
+	g.mu.Unlock()
+	delay := time.Until(start)
+	if delay <= 0 {
+		return nil
+	}
+	timer := time.NewTimer(delay)
+	defer timer.Stop()
+	select {
+	case <-ctx.Done():
+		return ctx.Err()
+	case <-timer.C:
+		return nil
+	}
+}
@@ -0,0 +1,25 @@
+package downloader
+
+import (
+	"bytes"
+	"testing"
+	"time"
+)
+
+// TestRateLimit checks that a download in several chunks, which share the rate limit, takes at least as long
+// as the file size at the rate, less the one burst the limiter allows
+func TestRateLimit(t *testing.T) {
+	content := testContent(300000)
+	const rate = 1000000
+	start := time.Now()
+	_, got := downloadFrom(t, serveContent(content), Downloader{Chunks: 4, RateLimit: rate})
+	elapsed := time.Since(start)
+	if !bytes.Equal(got, content) {
+		t.Fatal("downloaded file does not match the content")
+	}
+	limiter := newRateLimiter(rate)
+	minimum := time.Duration((float64(len(content)) - limiter.burst) / rate * float64(time.Second))
+	if elapsed < minimum {
+		t.Fatalf("download of %d bytes at %d bytes per second took %v, want at least %v", len(content), rate, elapsed, minimum)
+	}
+}
@@ -0,0 +1,466 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"mime"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// NewHTTPClient returns the client used for all requests when Downloader.Client is not set,
+// keeping up to maxConns idle connections to the server so that chunks reuse pooled keep-alive connections
+// instead of paying for a new TCP and TLS handshake each
+func NewHTTPClient(maxConns int) *http.Client {
+	tr := &http.Transport{
+		// Honor HTTP_PROXY, HTTPS_PROXY and NO_PROXY like the rest of Go's tooling
+		Proxy:               http.ProxyFromEnvironment,
+		DialContext:         newDialer(nil).DialContext,
+		TLSHandshakeTimeout: 10 * time.Second,
+		// A custom transport only negotiates HTTP/2 if asked to, so that chunks can be multiplexed over one connection
+		ForceAttemptHTTP2: true,
+		// Set DisableCompression to true (default is false)
+		// This ensures Go's internal transport behavior does not mess with our logic, byte ranges must be those
+		// of the file, a compressed single stream is only asked for and decompressed with Downloader.AcceptEncoding
+		DisableCompression:  true,
+		MaxIdleConns:        maxConns,
+		MaxIdleConnsPerHost: maxConns,
+		IdleConnTimeout:     90 * time.Second,
+	}
+	return &http.Client{Transport: tr}
+}
+
+// hostSet is a set of hostnames that is safe for concurrent use, as a re-check of the file size after
+// a 416 response can add a host while chunks are requested
+type hostSet struct {
+	mu    sync.Mutex
+	hosts map[string]bool
+}
+
+// newHostSet returns the set of the hostnames of dwLinks
+func newHostSet(dwLinks []string) *hostSet {
+	set := &hostSet{hosts: map[string]bool{}}
+	for _, dwLink := range dwLinks {
+		if parsed, err := url.Parse(dwLink); err == nil {
+			set.add(parsed.Hostname())
+		}
+	}
+	return set
+}
+
+func (s *hostSet) add(host string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.hosts[strings.ToLower(host)] = true
+}
+
+// has reports whether host is in the set, a nil set holds no host
+func (s *hostSet) has(host string) bool {
+	if s == nil {
+		return false
+	}
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	return s.hosts[strings.ToLower(host)]
+}
+
+// isFileURL reports whether dwLink is a file:// URL of a local file
+func isFileURL(dwLink string) bool {
+	parsed, err := url.Parse(dwLink)
+	return err == nil && parsed.Scheme == "file"
+}
+
+// newDialer returns the dialer of the default client, connecting from localAddr if it is not nil
+// It has the same connection timeouts as http.DefaultTransport, so that an unreachable server does not hang the download
+func newDialer(localAddr net.Addr) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   30 * time.Second,
+		KeepAlive: 30 * time.Second,
+		LocalAddr: localAddr,
+	}
+}
+
+// IPFamily selects the IP version connections to the server are made over
+type IPFamily int
+
+const (
+	// IPAuto tries IPv6 and IPv4 addresses of the server in parallel, and uses whichever connects first (happy eyeballs)
+	IPAuto IPFamily = iota
+	// IPv4 only connects over IPv4
+	IPv4
+	// IPv6 only connects over IPv6
+	IPv6
+)
+
+// dialContext returns the DialContext of the default client, which connects over d.IPFamily with dialer
+// and logs the address family of every new connection
+func (d *Downloader) dialContext(dialer *net.Dialer) func(ctx context.Context, network string, address string) (net.Conn, error) {
+	return func(ctx context.Context, network string, address string) (net.Conn, error) {
+		if network == "tcp" {
+			switch d.IPFamily {
+			case IPv4:
+				network = "tcp4"
+			case IPv6:
+				network = "tcp6"
+			}
+		}
+		conn, err := dialer.DialContext(ctx, network, address)
+		if err != nil {
+			return nil, err
+		}
+		family := "IPv6"
+		if addr, ok := conn.RemoteAddr().(*net.TCPAddr); ok && addr.IP.To4() != nil {
+			family = "IPv4"
+		}
+		d.debugf("Connected to %s over %s (%s from %s)", address, family, conn.RemoteAddr(), conn.LocalAddr())
+		return conn, nil
+	}
+}
+
+// newRequest creates a request for dwLink with the custom headers and configured authentication applied
+// Go's http.Client keeps these headers when following redirects to the same host
+// The Netrc credentials are looked up for the host of dwLink, so a mirror or redirect target gets its own
+// The request is aborted when ctx is canceled
+func (d *Downloader) newRequest(ctx context.Context, method string, dwLink string) (*http.Request, error) {
+	request, err := http.NewRequestWithContext(ctx, method, dwLink, nil)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range d.Header {
+		for _, value := range values {
+			request.Header.Add(name, value)
+		}
+	}
+	if request.Header.Get("User-Agent") == "" {
+		request.Header.Set("User-Agent", d.UserAgent)
+	}
+	// The credentials only go to the host of URL and of the Mirrors, and to a redirect target on another host
+	// once it answered 401, so that a CDN or a presigned URL does not get them with every chunk
+	trusted := d.authHosts.has(request.URL.Hostname())
+	if !trusted {
+		request.Header.Del("Authorization")
+	}
+	if d.BearerToken != "" || d.User != "" {
+		if trusted && d.BearerToken != "" {
+			request.Header.Set("Authorization", "Bearer "+d.BearerToken)
+		} else if trusted {
+			request.SetBasicAuth(d.User, d.Password)
+		}
+	} else if d.Header.Get("Authorization") == "" {
+		// A machine entry names the host it is for, the default entry is only sent to the trusted hosts
+		if entry, ok := lookupNetrc(d.netrc, request.URL.Hostname()); ok && (trusted || entry.machine != "") {
+			request.SetBasicAuth(entry.login, entry.password)
+		}
+	}
+	for _, cookie := range d.Cookies {
+		if cookieMatches(cookie, request.URL) {
+			request.AddCookie(cookie)
+		}
+	}
+	return request, nil
+}
+
+// checkRedirect is the CheckRedirect of the client, via holds the requests made so far, oldest first
+// The client has already copied the headers of the previous request to req, except for the Authorization
+// and Cookie headers on a redirect to another host, which confirmSupport sends again if the target asks for them
+func (d *Downloader) checkRedirect(req *http.Request, via []*http.Request) error {
+	chain := make([]string, 0, len(via)+1)
+	for _, previous := range via {
+		chain = append(chain, previous.URL.String())
+	}
+	chain = append(chain, req.URL.String())
+	if d.NoRedirects {
+		return fmt.Errorf("redirects are disabled, %s redirected to %s", via[len(via)-1].URL, req.URL)
+	}
+	// A server must not get local files read through a redirect to a file:// URL, or any other scheme
+	if req.URL.Scheme != "http" && req.URL.Scheme != "https" {
+		return fmt.Errorf("refusing to follow the redirect from %s to %s, only http and https URLs are followed", via[len(via)-1].URL, req.URL)
+	}
+	for _, previous := range via {
+		if previous.URL.String() == req.URL.String() {
+			return fmt.Errorf("redirect loop: %s", strings.Join(chain, " -> "))
+		}
+	}
+	if len(via) > d.MaxRedirects {
+		return fmt.Errorf("stopped after %d redirects: %s", d.MaxRedirects, strings.Join(chain, " -> "))
+	}
+	d.debugf("Redirect %d: %s -> %s", len(via), via[len(via)-1].URL, req.URL)
+	// The Cookie header is dropped on a redirect to another domain, which still gets the cookies set for it
+	if req.Header.Get("Cookie") == "" {
+		for _, cookie := range d.Cookies {
+			if cookie.Domain != "" && cookieMatches(cookie, req.URL) {
+				req.AddCookie(cookie)
+			}
+		}
+	}
+	return nil
+}
+
+// RemoteInfo is what the support check found out about the file to download, see Probe
+type RemoteInfo struct {
+	// FinalURL is where the file was found after following redirects, all further requests go there directly
+	FinalURL string
+	// Size is the size of the file, 0 if unknown, which it also is without support for HTTP Range requests
+	Size int64
+	// AcceptsRanges is whether the server at FinalURL supports HTTP Range requests
+	AcceptsRanges bool
+	// ETag and LastModified are the ETag and Last-Modified headers of the file, "" if there are none
+	ETag         string
+	LastModified string
+	// Filename is the filename from the Content-Disposition header, "" if there is none
+	Filename string
+	// ContentType is the Content-Type header of the file, "" if there is none
+	ContentType string
+	// ResolvedFilename is the filename the file is saved under without OutputPath, only set by Probe
+	ResolvedFilename string
+}
+
+// newRemoteInfo returns the RemoteInfo reported by the headers of response, without the size and range support
+func newRemoteInfo(response *http.Response) *RemoteInfo {
+	return &RemoteInfo{
+		FinalURL:     response.Request.URL.String(),
+		ETag:         response.Header.Get("ETag"),
+		LastModified: response.Header.Get("Last-Modified"),
+		Filename:     getContentDispositionFileName(response.Header.Get("Content-Disposition")),
+		ContentType:  response.Header.Get("Content-Type"),
+	}
+}
+
+// validator returns the ETag or Last-Modified date of the file, sent as If-Range with every chunk request
+func (r *RemoteInfo) validator() string {
+	if r.ETag != "" && !strings.HasPrefix(r.ETag, "W/") {
+		return r.ETag
+	}
+	return r.LastModified
+}
+
+// getValidator returns the strong ETag from the response headers, or else the Last-Modified date,
+// for use in an If-Range header, which does not allow weak ETags
+func getValidator(header http.Header) string {
+	remote := RemoteInfo{ETag: header.Get("ETag"), LastModified: header.Get("Last-Modified")}
+	return remote.validator()
+}
+
+// confirmSupport tests to see if "Accept-Ranges" is part of the HTTP Response header
+// Only the headers are fetched, using a HEAD request, or a ranged GET for a single byte if HEAD is not allowed
+// Any other HEAD response that is not 2xx is returned as a *StatusError
+// Redirects are followed and the support is checked on the final URL, which is where the chunks are requested from,
+// so that a redirect is only followed once and signed URLs on another host are checked for what they support
+// If HTTP Range requests are not supported, the file has to be downloaded in a single stream using downloadWhole
+// If the redirect target on another host asks for authentication and resendAuth is set, it is asked once more directly
+func (d *Downloader) confirmSupport(ctx context.Context, dwLink string, resendAuth bool) (*RemoteInfo, error) {
+	headRequest, err := d.newRequest(ctx, "HEAD", dwLink)
+	if err != nil {
+		return nil, err
+	}
+	response, err := d.Client.Do(headRequest)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP error: HEAD request failed: %w", err)
+	}
+	defer response.Body.Close()
+	d.debugf("HEAD %s: %s %s, Accept-Ranges: %q, Content-Length: %q", dwLink, response.Proto, response.Status, response.Header.Get("Accept-Ranges"), response.Header.Get("Content-Length"))
+	remote := newRemoteInfo(response)
+	if remote.FinalURL != dwLink {
+		if response.StatusCode == http.StatusUnauthorized && response.Request.URL.Host != headRequest.URL.Host && resendAuth {
+			// Go's http.Client does not forward the Authorization header to another host,
+			// ask the redirect target directly, once, so that the credentials are sent to it as well
+			d.println("Redirected to " + response.Request.URL.Host + ", which requires authentication, sending the credentials to it")
+			d.authHosts.add(response.Request.URL.Hostname())
+			return d.confirmSupport(ctx, remote.FinalURL, false)
+		}
+		d.println("Redirected to", response.Request.URL.Host)
+	}
+	if response.StatusCode == http.StatusMethodNotAllowed || response.StatusCode == http.StatusNotImplemented {
+		return d.confirmSupportWithRangedGet(ctx, remote.FinalURL)
+	}
+	// The headers of an error page, e.g. for a 404 Not Found, say nothing about the file
+	if response.StatusCode < 200 || response.StatusCode > 299 {
+		return nil, fmt.Errorf("HTTP error: HEAD request failed: %w", &StatusError{
+			StatusCode: response.StatusCode,
+			Status:     response.Status,
+			retryAfter: response.Header.Get("Retry-After"),
+		})
+	}
+	// A missing Accept-Ranges header is treated the same as "Accept-Ranges: none"
+	acceptRanges := response.Header.Get("Accept-Ranges")
+	if acceptRanges == "" || acceptRanges == "none" {
+		d.println("Server does not support HTTP Range requests (no Accept-Ranges Header in HTTP Response)")
+		return remote, nil
+	}
+	// Without the file size, e.g. with "Transfer-Encoding: chunked", there are no chunk boundaries to compute
+	contentLength := response.Header.Get("Content-Length")
+	if contentLength == "" {
+		d.println("Server did not send the file size (no Content-Length Header in HTTP Response)")
+		return remote, nil
+	}
+	remote.Size, err = strconv.ParseInt(contentLength, 10, 64)
+	if err != nil {
+		return nil, fmt.Errorf("Server Error: invalid Content-Length Header %q", contentLength)
+	}
+	remote.AcceptsRanges = true
+	return remote, nil
+}
+
+// confirmMirrors checks every mirror the same way as the primary URL and returns the ones chunks can be requested from
+// Mirrors that cannot be reached or do not support HTTP Range requests are skipped, but a mirror reporting
+// a different file size than the primary URL is an error, as its chunks would not fit together with the others
+func (d *Downloader) confirmMirrors(ctx context.Context, primary *RemoteInfo) ([]*RemoteInfo, error) {
+	var mirrors []*RemoteInfo
+	for _, mirror := range d.Mirrors {
+		remote, err := d.confirmSupport(ctx, mirror, true)
+		if err != nil {
+			d.println("Skipping mirror", mirror+":", err)
+			continue
+		}
+		if !remote.AcceptsRanges {
+			d.println("Skipping mirror", mirror, "as it does not support HTTP Range requests")
+			continue
+		}
+		if remote.Size != primary.Size {
+			return nil, fmt.Errorf("mirror %s reports a file size of %d bytes but %s reports %d bytes", mirror, remote.Size, d.URL, primary.Size)
+		}
+		mirrors = append(mirrors, remote)
+	}
+	return mirrors, nil
+}
+
+// confirmSupportWithRangedGet is the fallback for servers that do not allow HEAD requests
+// It asks for the first byte only, a 206 Partial Content response confirms support for HTTP Range requests
+// and the filesize is read from the total in the Content-Range header, or in that of the first part
+// of a multipart/byteranges response
+func (d *Downloader) confirmSupportWithRangedGet(ctx context.Context, dwLink string) (*RemoteInfo, error) {
+	craftRequest, err := d.newRequest(ctx, "GET", dwLink)
+	if err != nil {
+		return nil, err
+	}
+	craftRequest.Header.Add("Range", "bytes=0-0")
+	response, err := d.Client.Do(craftRequest)
+	if err != nil {
+		return nil, fmt.Errorf("HTTP error: ranged GET request failed: %w", err)
+	}
+	defer response.Body.Close()
+	d.debugf("GET %s bytes=0-0: %s %s, Content-Range: %q", dwLink, response.Proto, response.Status, response.Header.Get("Content-Range"))
+	remote := newRemoteInfo(response)
+	if response.StatusCode != http.StatusPartialContent {
+		d.println("Server does not support HTTP Range requests (ranged GET was answered with", response.Status+")")
+		return remote, nil
+	}
+	contentRange := response.Header.Get("Content-Range")
+	if boundary, ok := byteRangesBoundary(response.Header); ok {
+		header, err := firstPartHeader(response.Body, boundary)
+		if err != nil {
+			return nil, err
+		}
+		contentRange = header.Get("Content-Range")
+		remote.ContentType = header.Get("Content-Type")
+	}
+	remote.Size, err = parseContentRangeTotal(contentRange)
+	if errors.Is(err, errUnknownSize) {
+		d.println("Server did not send the file size (no total in Content-Range Header)")
+		return remote, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	remote.AcceptsRanges = true
+	return remote, nil
+}
+
+// errUnknownSize is returned by parseContentRangeTotal for a Content-Range header with a "*" total
+var errUnknownSize = errors.New("Server Error: Content-Range header does not include the file size")
+
+// parseContentRangeTotal returns the complete length from a Content-Range header such as "bytes 0-0/12345"
+func parseContentRangeTotal(contentRange string) (int64, error) {
+	slash := strings.LastIndex(contentRange, "/")
+	if !strings.HasPrefix(contentRange, "bytes ") || slash == -1 {
+		return 0, fmt.Errorf("Server Error: malformed Content-Range header %q", contentRange)
+	}
+	total := contentRange[slash+1:]
+	if total == "*" {
+		return 0, errUnknownSize
+	}
+	return strconv.ParseInt(total, 10, 64)
+}
+
+// checkTotal returns an error wrapping ErrSizeMismatch if the total from a Content-Range header is known and not fileSize
+func checkTotal(total int64, fileSize int64) error {
+	if total == -1 || total == fileSize {
+		return nil
+	}
+	return fmt.Errorf("Server Error: %w: the support check reported %d bytes but the Content-Range header %d bytes, a proxy in between may be rewriting the responses, or the file changed upstream", ErrSizeMismatch, fileSize, total)
+}
+
+// parseContentRange returns the first and last byte and the complete length from a Content-Range header
+// such as "bytes 0-1048575/52428800", the complete length is -1 if the header has a "*" instead
+func parseContentRange(contentRange string) (int64, int64, int64, error) {
+	total, err := parseContentRangeTotal(contentRange)
+	if errors.Is(err, errUnknownSize) {
+		total = -1
+	} else if err != nil {
+		return 0, 0, 0, err
+	}
+	byteRange := strings.TrimPrefix(contentRange[:strings.LastIndex(contentRange, "/")], "bytes ")
+	dash := strings.Index(byteRange, "-")
+	if dash == -1 {
+		return 0, 0, 0, fmt.Errorf("Server Error: malformed Content-Range header %q", contentRange)
+	}
+	first, err := strconv.ParseInt(byteRange[:dash], 10, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("Server Error: malformed Content-Range header %q", contentRange)
+	}
+	last, err := strconv.ParseInt(byteRange[dash+1:], 10, 64)
+	if err != nil {
+		return 0, 0, 0, fmt.Errorf("Server Error: malformed Content-Range header %q", contentRange)
+	}
+	return first, last, total, nil
+}
+
+// defaultFileName is used when no safe filename can be derived from the URL
+const defaultFileName = "download"
+
+// getDownloadFileName returns the filename of the file hosted at the URL to download
+func getDownloadFileName(dwLink string) string {
+	parsed, err := url.Parse(dwLink)
+	if err != nil {
+		return defaultFileName
+	}
+	urlParts := strings.Split(parsed.EscapedPath(), "/")
+	filename, err := url.PathUnescape(urlParts[len(urlParts)-1])
+	if err != nil {
+		return defaultFileName
+	}
+	return sanitizeFileName(filename)
+}
+
+// getContentDispositionFileName returns the filename from a Content-Disposition header
+// such as `attachment; filename="foo.tar.gz"`, or "" if there is none
+// The extended RFC 5987 filename* parameter, e.g. for non-ASCII names, is decoded by mime.ParseMediaType and takes precedence
+func getContentDispositionFileName(contentDisposition string) string {
+	if contentDisposition == "" {
+		return ""
+	}
+	_, params, err := mime.ParseMediaType(contentDisposition)
+	if err != nil || params["filename"] == "" {
+		return ""
+	}
+	return sanitizeFileName(params["filename"])
+}
+
+// sanitizeFileName drops anything up to a path separator in filename,
+// so that encoded slashes or dot-dot segments can never point outside the current directory
+func sanitizeFileName(filename string) string {
+	if i := strings.LastIndexAny(filename, `/\`); i != -1 {
+		filename = filename[i+1:]
+	}
+	filename = strings.TrimSpace(strings.ReplaceAll(filename, "\x00", ""))
+	if filename == "" || filename == "." || filename == ".." {
+		return defaultFileName
+	}
+	return filename
+}
@@ -0,0 +1,251 @@
+package downloader
+
+import (
+	"bytes"
+	"context"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// testContent returns size bytes of test data
+func testContent(size int) []byte {
+	content := make([]byte, size)
+	for i := range content {
+		content[i] = byte(i * 7)
+	}
+	return content
+}
+
+// serveContent serves content with support for HTTP Range requests
+func serveContent(content []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		http.ServeContent(w, r, "file.bin", time.Time{}, bytes.NewReader(content))
+	}
+}
+
+// serveWithoutRanges serves content with a Content-Length but without an Accept-Ranges header,
+// answering every request, including ranged ones, with the whole file
+func serveWithoutRanges(content []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Length", strconv.Itoa(len(content)))
+		if r.Method != http.MethodHead {
+			w.Write(content)
+		}
+	}
+}
+
+// serveWithoutLength serves content with an Accept-Ranges header but without a Content-Length,
+// the response is flushed before the body so that it uses chunked transfer encoding
+func serveWithoutLength(content []byte) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Accept-Ranges", "bytes")
+		w.WriteHeader(http.StatusOK)
+		if r.Method == http.MethodHead {
+			return
+		}
+		w.(http.Flusher).Flush()
+		w.Write(content)
+	}
+}
+
+// authRecorder records the Authorization headers of the requests to a handler
+type authRecorder struct {
+	mu      sync.Mutex
+	headers []string
+}
+
+func (a *authRecorder) record(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		a.mu.Lock()
+		a.headers = append(a.headers, r.Header.Get("Authorization"))
+		a.mu.Unlock()
+		next(w, r)
+	}
+}
+
+// TestRedirectToFileURL checks that a server cannot have a local file read by redirecting to it
+func TestRedirectToFileURL(t *testing.T) {
+	dir := t.TempDir()
+	secret := filepath.Join(dir, "secret.txt")
+	if err := os.WriteFile(secret, []byte("secret"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, "file://"+filepath.ToSlash(secret), http.StatusFound)
+	}))
+	defer server.Close()
+
+	output := filepath.Join(dir, "out")
+	d := Downloader{URL: server.URL + "/f", OutputPath: output}
+	if _, err := d.Download(context.Background()); err == nil {
+		t.Fatal("Download followed a redirect to a file:// URL")
+	}
+	if _, err := os.Stat(output); !os.IsNotExist(err) {
+		t.Fatalf("output file was created: %v", err)
+	}
+}
+
+// TestFileURL checks that a file:// URL passed by the user is still downloaded from the local filesystem
+func TestFileURL(t *testing.T) {
+	dir := t.TempDir()
+	source := filepath.Join(dir, "source.bin")
+	if err := os.WriteFile(source, []byte("local file"), 0o600); err != nil {
+		t.Fatal(err)
+	}
+	output := filepath.Join(dir, "out")
+	d := Downloader{URL: "file://" + filepath.ToSlash(source), OutputPath: output}
+	if _, err := d.Download(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "local file" {
+		t.Fatalf("got %q, want %q", got, "local file")
+	}
+}
+
+// redirectingServers starts a server on 127.0.0.1 that redirects every request to target, served on localhost,
+// which is another host as far as the credentials are concerned
+func redirectingServers(t *testing.T, target http.HandlerFunc) *httptest.Server {
+	targetServer := httptest.NewServer(target)
+	t.Cleanup(targetServer.Close)
+	targetURL := strings.Replace(targetServer.URL, "127.0.0.1", "localhost", 1)
+	origin := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		http.Redirect(w, r, targetURL+r.URL.Path, http.StatusFound)
+	}))
+	t.Cleanup(origin.Close)
+	return origin
+}
+
+// TestCredentialsNotSentToRedirectTarget checks that a redirect target on another host that does not ask
+// for authentication never gets the credentials, neither in the support check nor with the chunks
+func TestCredentialsNotSentToRedirectTarget(t *testing.T) {
+	content := testContent(100000)
+	var target authRecorder
+	origin := redirectingServers(t, target.record(serveContent(content)))
+
+	output := filepath.Join(t.TempDir(), "out")
+	d := Downloader{URL: origin.URL + "/file.bin", OutputPath: output, Chunks: 4, BearerToken: "secret"}
+	if _, err := d.Download(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	if len(target.headers) < 5 {
+		t.Fatalf("got %d requests to the redirect target, want the support check and 4 chunks", len(target.headers))
+	}
+	for _, header := range target.headers {
+		if header != "" {
+			t.Fatalf("redirect target got Authorization %q", header)
+		}
+	}
+}
+
+// TestCredentialsSentToRedirectTargetAskingForThem checks that a redirect target on another host that answers 401
+// gets the credentials, with the support check asked again and with every chunk
+func TestCredentialsSentToRedirectTargetAskingForThem(t *testing.T) {
+	content := testContent(100000)
+	var target authRecorder
+	origin := redirectingServers(t, target.record(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Authorization") != "Bearer secret" {
+			w.WriteHeader(http.StatusUnauthorized)
+			return
+		}
+		serveContent(content)(w, r)
+	}))
+
+	output := filepath.Join(t.TempDir(), "out")
+	d := Downloader{URL: origin.URL + "/file.bin", OutputPath: output, Chunks: 4, BearerToken: "secret"}
+	if _, err := d.Download(context.Background()); err != nil {
+		t.Fatal(err)
+	}
+	got, err := os.ReadFile(output)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(got, content) {
+		t.Fatal("downloaded file does not match the content")
+	}
+	// Only the first request, redirected by the client, goes without them
+	for _, header := range target.headers[1:] {
+		if header != "Bearer secret" {
+			t.Fatalf("redirect target got Authorization %q after answering 401", header)
+		}
+	}
+}
+
+// TestProbe checks what the support check finds out about a server with range support, one without,
+// and one that does not send the file size, through the client of the httptest server
+func TestProbe(t *testing.T) {
+	content := testContent(1000)
+	tests := []struct {
+		name          string
+		handler       http.HandlerFunc
+		acceptsRanges bool
+		size          int64
+	}{
+		{"ranges", serveContent(content), true, 1000},
+		{"no ranges", serveWithoutRanges(content), false, 0},
+		{"no Content-Length", serveWithoutLength(content), false, 0},
+	}
+	for _, test := range tests {
+		t.Run(test.name, func(t *testing.T) {
+			server := httptest.NewServer(test.handler)
+			defer server.Close()
+			d := Downloader{URL: server.URL + "/file.bin", Client: server.Client()}
+			remote, err := d.Probe(context.Background())
+			if err != nil {
+				t.Fatal(err)
+			}
+			if remote.AcceptsRanges != test.acceptsRanges || remote.Size != test.size {
+				t.Fatalf("got AcceptsRanges %v and Size %d, want %v and %d", remote.AcceptsRanges, remote.Size, test.acceptsRanges, test.size)
+			}
+			if remote.FinalURL != d.URL {
+				t.Fatalf("got FinalURL %s, want %s", remote.FinalURL, d.URL)
+			}
+		})
+	}
+}
+
+// TestProbeHeadStatus checks that a HEAD request answered with an error page fails the support check, even with
+// the headers of a file, and that a server that does not allow HEAD is checked with a ranged GET instead
+func TestProbeHeadStatus(t *testing.T) {
+	content := testContent(1000)
+	for _, status := range []int{http.StatusForbidden, http.StatusNotFound, http.StatusInternalServerError} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			w.Header().Set("Accept-Ranges", "bytes")
+			w.Header().Set("Content-Length", "1000")
+			w.WriteHeader(status)
+		}))
+		d := Downloader{URL: server.URL + "/file.bin", Client: server.Client()}
+		_, err := d.Probe(context.Background())
+		server.Close()
+		var statusErr *StatusError
+		if !errors.As(err, &statusErr) || statusErr.StatusCode != status {
+			t.Errorf("HEAD answered with %d: got %v, want a *StatusError with that status", status, err)
+		}
+	}
+	for _, status := range []int{http.StatusMethodNotAllowed, http.StatusNotImplemented} {
+		server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			if r.Method == http.MethodHead {
+				w.WriteHeader(status)
+				return
+			}
+			serveContent(content)(w, r)
+		}))
+		d := Downloader{URL: server.URL + "/file.bin", Client: server.Client()}
+		remote, err := d.Probe(context.Background())
+		server.Close()
+		if err != nil || !remote.AcceptsRanges || remote.Size != 1000 {
+			t.Errorf("HEAD answered with %d: got %+v, %v, want range support for a 1000 byte file", status, remote, err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package downloader
+
+import (
+	"context"
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// reassignInterval is how often the scheduler samples the throughput of the chunks and mirrors
+const reassignInterval = time.Second
+
+// reassignWindow is the number of samples in the sliding window the throughput is measured over
+const reassignWindow = 5
+
+// slowChunkFraction is the fraction of the best mirror's rate per connection below which a chunk is reassigned
+const slowChunkFraction = 0.5
+
+// sourceSample is a sample of the cumulative bytes received from a mirror
+// and the cumulative connection-seconds spent downloading from it
+type sourceSample struct {
+	bytes       int64
+	connSeconds float64
+}
+
+// minSampleConnSeconds is the minimum connection time in a window for the rate of a source to be measured
+const minSampleConnSeconds = 0.1
+
+// sourceStats tracks the throughput of one of the URLs chunks are downloaded from
+type sourceStats struct {
+	// bytes is the total number of bytes received from the source, updated atomically
+	bytes int64
+	// connSeconds is the total time chunks spent downloading from the source
+	connSeconds float64
+	samples     []sourceSample
+	// rate is the last measured rate per connection in bytes per second, kept once the source
+	// has no chunks left to download, as that is when other chunks are reassigned to it
+	rate float64
+}
+
+// chunkState tracks the throughput of a chunk while it is downloading from a source
+type chunkState struct {
+	// bytes is the number of bytes received by the chunk from its current source, updated atomically
+	bytes   int64
+	source  int
+	samples []int64
+	cancel  context.CancelFunc
+	// counted is the time up to which the chunk's connection time was added to its source
+	counted time.Time
+	// reassignTo is the source the chunk was reassigned to after being canceled, -1 if it was not
+	reassignTo int
+}
+
+// scheduler measures the throughput of every source over a sliding window, and reassigns chunks
+// that are much slower than the best source to it, so the download is not held up by a slow mirror
+type scheduler struct {
+	mu      sync.Mutex
+	sources []*sourceStats
+	chunks  map[int64]*chunkState
+}
+
+func newScheduler(numSources int) *scheduler {
+	s := &scheduler{chunks: map[int64]*chunkState{}}
+	for i := 0; i < numSources; i++ {
+		s.sources = append(s.sources, &sourceStats{samples: []sourceSample{{}}})
+	}
+	return s
+}
+
+// start registers chunk as downloading from source, canceling it with cancel if it gets reassigned
+// The returned reader counts the bytes read from body towards the throughput of the chunk and the source
+func (s *scheduler) start(chunk int64, source int, cancel context.CancelFunc, body io.ReadCloser) io.ReadCloser {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := &chunkState{source: source, cancel: cancel, reassignTo: -1, counted: time.Now()}
+	s.chunks[chunk] = state
+	return &countingReader{ReadCloser: body, counters: []*int64{&state.bytes, &s.sources[source].bytes}}
+}
+
+// finish unregisters chunk and returns the source it was reassigned to, or -1 if it was not
+func (s *scheduler) finish(chunk int64) int {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	state := s.chunks[chunk]
+	delete(s.chunks, chunk)
+	s.sources[state.source].connSeconds += time.Since(state.counted).Seconds()
+	return state.reassignTo
+}
+
+// run samples the throughput every reassignInterval until done is closed
+func (s *scheduler) run(done <-chan struct{}) {
+	ticker := time.NewTicker(reassignInterval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+			s.tick()
+		}
+	}
+}
+
+// tick takes a sample of every source and chunk, and cancels the chunks that are slower than
+// slowChunkFraction of the best source's rate per connection so that they are reassigned to it
+// A chunk is only judged once it has been downloading from its source for a whole window
+func (s *scheduler) tick() {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+
+	now := time.Now()
+	for _, state := range s.chunks {
+		s.sources[state.source].connSeconds += now.Sub(state.counted).Seconds()
+		state.counted = now
+	}
+	best, bestRate := -1, 0.0
+	for i, source := range s.sources {
+		source.samples = appendWindow(source.samples, sourceSample{atomic.LoadInt64(&source.bytes), source.connSeconds})
+		first, last := source.samples[0], source.samples[len(source.samples)-1]
+		if connSeconds := last.connSeconds - first.connSeconds; connSeconds >= minSampleConnSeconds {
+			source.rate = float64(last.bytes-first.bytes) / connSeconds
+		}
+		if source.rate > bestRate {
+			best, bestRate = i, source.rate
+		}
+	}
+
+	for _, state := range s.chunks {
+		state.samples = append(state.samples, atomic.LoadInt64(&state.bytes))
+		if len(state.samples) > reassignWindow+1 {
+			state.samples = state.samples[1:]
+		}
+		if best == -1 || state.source == best || state.reassignTo != -1 || len(state.samples) <= reassignWindow {
+			continue
+		}
+		rate := float64(state.samples[reassignWindow]-state.samples[0]) / (reassignWindow * reassignInterval.Seconds())
+		if rate < slowChunkFraction*bestRate {
+			state.reassignTo = best
+			state.cancel()
+		}
+	}
+}
+
+// appendWindow appends a sample, dropping the oldest one once there are more than reassignWindow+1
+func appendWindow(samples []sourceSample, sample sourceSample) []sourceSample {
+	samples = append(samples, sample)
+	if len(samples) > reassignWindow+1 {
+		samples = samples[1:]
+	}
+	return samples
+}
+
+// countingReader adds the number of bytes read to every counter
+type countingReader struct {
+	io.ReadCloser
+	counters []*int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	for _, counter := range r.counters {
+		atomic.AddInt64(counter, int64(n))
+	}
+	return n, err
+}
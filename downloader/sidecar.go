@@ -0,0 +1,105 @@
+package downloader
+
+import (
+	"context"
+	"crypto/sha256"
+	"encoding/hex"
+	"fmt"
+	"io"
+	"net/http"
+	"net/url"
+	"path"
+	"strings"
+)
+
+// maxSidecarSize is the maximum size of a .sha256 file, to not read a huge file served at its URL by mistake
+const maxSidecarSize = 1 << 20
+
+// sidecarURL returns the URL of the .sha256 file published next to the file at dwLink, the query is kept
+func sidecarURL(dwLink string) (string, error) {
+	parsed, err := url.Parse(dwLink)
+	if err != nil {
+		return "", err
+	}
+	parsed.Path += ".sha256"
+	parsed.RawPath = ""
+	return parsed.String(), nil
+}
+
+// fetchSidecar downloads the .sha256 file next to d.URL and returns the hex encoded SHA256 checksum
+// it lists for the file, which is looked up by the filename from the URL or from the Content-Disposition header
+func (d *Downloader) fetchSidecar(ctx context.Context, remote *RemoteInfo) (string, error) {
+	sidecar, err := sidecarURL(d.URL)
+	if err != nil {
+		return "", err
+	}
+	request, err := d.newRequest(ctx, "GET", sidecar)
+	if err != nil {
+		return "", err
+	}
+	response, err := d.Client.Do(request)
+	if err != nil {
+		return "", fmt.Errorf("HTTP error: GET request failed: %w", err)
+	}
+	defer response.Body.Close()
+	d.debugf("GET %s: %s %s", sidecar, response.Proto, response.Status)
+	if response.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("HTTP error: GET request for %s failed: %w", sidecar, &StatusError{StatusCode: response.StatusCode, Status: response.Status})
+	}
+	content, err := io.ReadAll(io.LimitReader(response.Body, maxSidecarSize))
+	if err != nil {
+		return "", fmt.Errorf("Error while reading %s: %w", sidecar, err)
+	}
+	names := []string{getDownloadFileName(d.URL)}
+	if remote.Filename != "" {
+		names = append(names, remote.Filename)
+	}
+	checksum, err := parseSidecar(string(content), names)
+	if err != nil {
+		return "", fmt.Errorf("%s: %w", sidecar, err)
+	}
+	d.println("Verifying against the SHA256 checksum from", sidecar)
+	return checksum, nil
+}
+
+// parseSidecar returns the checksum for one of names from the content of a .sha256 file in the sha256sum format,
+// "<hash>  <filename>" per line with an optional * before binary files, or the BSD "SHA256 (<filename>) = <hash>"
+// format, a file with a single line may also hold the hash alone
+// Filenames are matched without their directory, as some files list paths relative to where they were created
+func parseSidecar(content string, names []string) (string, error) {
+	var lines []string
+	for _, line := range strings.Split(content, "\n") {
+		if line = strings.TrimSpace(line); line != "" && !strings.HasPrefix(line, "#") {
+			lines = append(lines, line)
+		}
+	}
+	for _, line := range lines {
+		var checksum, filename string
+		if strings.HasPrefix(line, "SHA256 (") && strings.Contains(line, ") = ") {
+			i := strings.LastIndex(line, ") = ")
+			filename, checksum = line[len("SHA256 ("):i], line[i+len(") = "):]
+		} else {
+			fields := strings.Fields(line)
+			checksum = fields[0]
+			if len(fields) == 1 && len(lines) == 1 {
+				return validSidecarChecksum(checksum)
+			}
+			filename = strings.TrimPrefix(strings.TrimSpace(strings.TrimPrefix(line, fields[0])), "*")
+		}
+		base := path.Base(strings.ReplaceAll(filename, `\`, "/"))
+		for _, name := range names {
+			if base == name {
+				return validSidecarChecksum(checksum)
+			}
+		}
+	}
+	return "", fmt.Errorf("no SHA256 checksum listed for %s", strings.Join(names, " or "))
+}
+
+// validSidecarChecksum checks that checksum is a hex encoded SHA256 checksum
+func validSidecarChecksum(checksum string) (string, error) {
+	if sum, err := hex.DecodeString(checksum); err != nil || len(sum) != sha256.Size {
+		return "", fmt.Errorf("%q is not a hex encoded SHA256 checksum", checksum)
+	}
+	return checksum, nil
+}
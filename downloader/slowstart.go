@@ -0,0 +1,62 @@
+package downloader
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+// slowStartConnections is the number of chunks downloaded at the same time when a download starts with SlowStart
+const slowStartConnections = 2
+
+// slowStartInterval is how often the number of connections is doubled with SlowStart
+const slowStartInterval = 2 * time.Second
+
+// slowStartGain is the minimum increase of the throughput after doubling the connections for them to be doubled again
+const slowStartGain = 1.1
+
+// holdSlowStartSlots takes the slots of the tokens semaphore beyond slowStartConnections before any chunk starts,
+// and returns how many it took
+func holdSlowStartSlots(tokens chan struct{}) int {
+	held := 0
+	for ; held < cap(tokens)-slowStartConnections; held++ {
+		tokens <- struct{}{}
+	}
+	return held
+}
+
+// slowStart frees the held slots of the tokens semaphore, twice as many as are in use every slowStartInterval,
+// until all of them are free or the throughput stops improving
+// The slots still held when done is closed are never freed, as no chunk is waiting for them anymore
+func (d *Downloader) slowStart(tokens chan struct{}, held int, downloaded *int64, done <-chan struct{}) {
+	ticker := time.NewTicker(slowStartInterval)
+	defer ticker.Stop()
+	connections := slowStartConnections
+	last := atomic.LoadInt64(downloaded)
+	var lastRate float64
+	for held > 0 {
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+		current := atomic.LoadInt64(downloaded)
+		rate := float64(current-last) / slowStartInterval.Seconds()
+		last = current
+		if lastRate > 0 && rate < lastRate*slowStartGain {
+			d.printAboveProgress(fmt.Sprintf("Slow start: the throughput stopped improving, staying at %d connections", connections))
+			return
+		}
+		lastRate = rate
+		free := connections
+		if free > held {
+			free = held
+		}
+		for i := 0; i < free; i++ {
+			<-tokens
+		}
+		held -= free
+		connections += free
+		d.printAboveProgress(fmt.Sprintf("Slow start: %d connections at %s/s so far, raising to %d", connections-free, FormatBytes(int64(rate)), connections))
+	}
+}
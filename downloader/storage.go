@@ -0,0 +1,274 @@
+package downloader
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"hash"
+	"io"
+	"os"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Storage receives the chunks of a download at their offsets in the file, e.g. an object storage upload
+// WriteAt is called concurrently by the chunks, each writing its own byte range in order
+// Finalize is called once every byte has been written, it is not called if the download fails
+// If a Storage also implements io.ReaderAt, the checksums are calculated by reading the file back from it
+type Storage interface {
+	io.WriterAt
+	Finalize() error
+}
+
+// partFile is the default Storage, the OutputPath.part file that is renamed to OutputPath once complete
+type partFile struct {
+	*os.File
+	finalPath string
+}
+
+// Finalize renames the .part file to its final path, the file must be closed already
+func (f *partFile) Finalize() error {
+	if err := os.Rename(f.Name(), f.finalPath); err != nil {
+		return fmt.Errorf("Fatal error in renaming %s to %s: %w", f.Name(), f.finalPath, err)
+	}
+	return nil
+}
+
+// ErrTooLarge is returned by DownloadBytes for a file larger than its maximum size
+var ErrTooLarge = errors.New("file is larger than the maximum size to download into memory")
+
+// sizedStorage is a Storage that is told the size of the file before the chunks are written to it
+type sizedStorage interface {
+	Storage
+	reserve(size int64) error
+}
+
+// memoryStorage is the Storage of DownloadBytes, a buffer of at most maxSize bytes
+// It is allocated at the size of the file when that is known, and grows with the writes of a single stream otherwise
+type memoryStorage struct {
+	mu      sync.Mutex
+	buf     []byte
+	maxSize int64
+}
+
+// reserve allocates the buffer for a file of size bytes, or fails with ErrTooLarge before anything is downloaded
+func (m *memoryStorage) reserve(size int64) error {
+	if size > m.maxSize {
+		return fmt.Errorf("Bad Input: %w, the file is %d bytes and the maximum is %d bytes", ErrTooLarge, size, m.maxSize)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	m.buf = make([]byte, size)
+	return nil
+}
+
+func (m *memoryStorage) WriteAt(p []byte, off int64) (int, error) {
+	end := off + int64(len(p))
+	if end > m.maxSize {
+		return 0, fmt.Errorf("%w, the maximum is %d bytes", ErrTooLarge, m.maxSize)
+	}
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if end > int64(len(m.buf)) {
+		if end > int64(cap(m.buf)) {
+			// Double the buffer so that a single stream is not copied on every write
+			grown := make([]byte, end, min(2*end, m.maxSize))
+			copy(grown, m.buf)
+			m.buf = grown
+		}
+		m.buf = m.buf[:end]
+	}
+	copy(m.buf[off:], p)
+	return len(p), nil
+}
+
+func (m *memoryStorage) ReadAt(p []byte, off int64) (int, error) {
+	m.mu.Lock()
+	defer m.mu.Unlock()
+	if off >= int64(len(m.buf)) {
+		return 0, io.EOF
+	}
+	n := copy(p, m.buf[off:])
+	if n < len(p) {
+		return n, io.EOF
+	}
+	return n, nil
+}
+
+func (m *memoryStorage) Finalize() error {
+	return nil
+}
+
+// DownloadBytes downloads the file at d.URL like Download, but into memory instead of OutputPath, and returns it
+// The chunks are written concurrently into a single buffer, so no temporary file is needed for small files
+// A file larger than maxSize bytes fails with ErrTooLarge, before it is downloaded if the server reports its size
+func (d *Downloader) DownloadBytes(ctx context.Context, maxSize int64) ([]byte, error) {
+	if maxSize <= 0 {
+		return nil, &InputError{Err: fmt.Errorf("Bad Input: maximum size must be at least 1 byte, got %d", maxSize)}
+	}
+	if d.Writer != nil || d.Storage != nil {
+		return nil, &InputError{Err: errors.New("Bad Input: DownloadBytes cannot be combined with Writer or Storage")}
+	}
+	memory := &memoryStorage{maxSize: maxSize}
+	dl := *d
+	dl.Storage = memory
+	if _, err := dl.Download(ctx); err != nil {
+		return nil, err
+	}
+	return memory.buf, nil
+}
+
+// offsetWriter writes a single stream sequentially to a Storage
+type offsetWriter struct {
+	w      io.WriterAt
+	offset int64
+}
+
+func (o *offsetWriter) Write(p []byte) (int, error) {
+	n, err := o.w.WriteAt(p, o.offset)
+	o.offset += int64(n)
+	return n, err
+}
+
+// sectionWriter writes at offsets relative to base, so that a range of the remote file is saved from offset 0
+type sectionWriter struct {
+	w    io.WriterAt
+	base int64
+}
+
+func (s *sectionWriter) WriteAt(p []byte, off int64) (int, error) {
+	return s.w.WriteAt(p, off-s.base)
+}
+
+// downloadToStorage downloads size bytes from rangeStart of the file to d.Storage, in parallel chunks from dwLinks
+// if the server supports HTTP Range requests, and finalizes it once all bytes have been written and the checksums verified
+func (d *Downloader) downloadToStorage(ctx context.Context, remote *RemoteInfo, dwLinks []string, rangeStart int64, size int64) (*Result, error) {
+	var downloaded int64
+	progressDone := make(chan struct{})
+	progressStopped := make(chan struct{})
+	stopProgress := func() {
+		close(progressDone)
+		<-progressStopped
+	}
+	var checksums map[string][]byte
+	var merkleRoot []byte
+	var merkleChunks int64
+	numChunks := int64(1)
+	// timings are the times of the chunks, nil for a single stream
+	var timings *chunkTimings
+	startTime := time.Now()
+	if sized, ok := d.Storage.(sizedStorage); ok && remote.AcceptsRanges {
+		if err := sized.reserve(size); err != nil {
+			return nil, err
+		}
+	}
+	if remote.AcceptsRanges {
+		numChunks = d.Chunks
+		if numChunks == 0 {
+			numChunks = ChunksForSize(size)
+		}
+		chunks := ComputeChunks(size, numChunks)
+		for i := range chunks {
+			chunks[i].Start += rangeStart
+			chunks[i].End += rangeStart
+		}
+		numChunks = int64(len(chunks))
+		if d.MaxConcurrent > numChunks && numChunks > 0 {
+			d.MaxConcurrent = numChunks
+		}
+		// An empty file has no chunks, the storage is still finalized with the checksums of no bytes
+		if numChunks == 0 {
+			d.println("Remote file is empty, nothing to download")
+		} else {
+			d.println("Downloading in ", numChunks, " chunks, ", d.MaxConcurrent, " at a time from ", len(dwLinks), " source(s) to the storage...")
+		}
+		var w io.WriterAt = d.Storage
+		var tree *merkleTree
+		if d.Merkle {
+			tree = newMerkleTree(size, d.merkleChunks(size))
+			w = &merkleWriter{w: d.Storage, tree: tree}
+		}
+		go d.printProgress(&downloaded, size, progressDone, progressStopped)
+		timings = newChunkTimings()
+		failed := d.downloadChunks(ctx, dwLinks, &sectionWriter{w: w, base: rangeStart}, chunks, remote.Size, &downloaded, nil, timings)
+		stopProgress()
+		if len(failed) > 0 {
+			if ctx.Err() != nil {
+				return nil, fmt.Errorf("download canceled: %w", ctx.Err())
+			}
+			return nil, &ChunksError{Failed: failed, Chunks: numChunks}
+		}
+		if downloaded != size {
+			return nil, fmt.Errorf("Fatal error: downloaded %d bytes instead of the expected %d bytes", downloaded, size)
+		}
+		if tree != nil {
+			// A Storage is never resumed, so every chunk has been hashed while it was written from its start
+			reader, _ := d.Storage.(io.ReaderAt)
+			merkleChunks = int64(len(tree.leaves))
+			var err error
+			if merkleRoot, err = d.merkleRoot(tree, reader); err != nil {
+				return nil, fmt.Errorf("Error while calculating the Merkle root: %w", err)
+			}
+		}
+		if !d.NoChecksum {
+			reader, ok := d.Storage.(io.ReaderAt)
+			if !ok {
+				d.println("The storage cannot be read back, skipping the checksums")
+			} else {
+				var err error
+				if checksums, err = hashReader(io.NewSectionReader(reader, 0, size), d.Hashes); err != nil {
+					return nil, fmt.Errorf("Error while calculating checksums: %w", err)
+				}
+			}
+		}
+	} else {
+		// The single stream is written in order, so it is hashed on the fly
+		var hashes map[string]hash.Hash
+		var hashWriter io.Writer
+		if !d.NoChecksum {
+			var err error
+			if hashes, hashWriter, err = newHashes(d.Hashes); err != nil {
+				return nil, err
+			}
+		}
+		var leaf hash.Hash
+		if d.Merkle {
+			leaf = newLeafHash()
+			hashWriter = leaf
+		}
+		d.println("Downloading in a single stream to the storage...")
+		go d.printProgress(&downloaded, remote.Size, progressDone, progressStopped)
+		err := d.downloadWhole(ctx, remote.FinalURL, &offsetWriter{w: d.Storage}, hashWriter, &downloaded)
+		stopProgress()
+		if err != nil {
+			return nil, fmt.Errorf("Fatal error in single stream download: %w", err)
+		}
+		if hashes != nil {
+			checksums = sums(hashes)
+		}
+		if leaf != nil {
+			merkleRoot, merkleChunks = singleLeafRoot(leaf, atomic.LoadInt64(&downloaded))
+		}
+	}
+	elapsed := time.Since(startTime)
+	if err := verifyChecksums(checksums, d.Expected); err != nil {
+		return nil, err
+	}
+	if err := verifyMerkleRoot(merkleRoot, d.ExpectedMerkleRoot); err != nil {
+		return nil, err
+	}
+	if err := d.Storage.Finalize(); err != nil {
+		return nil, fmt.Errorf("Fatal error in finalizing the storage: %w", err)
+	}
+	return &Result{
+		Bytes:        atomic.LoadInt64(&downloaded),
+		Chunks:       numChunks,
+		Elapsed:      elapsed,
+		Checksums:    checksums,
+		SHA256:       checksums["sha256"],
+		MerkleRoot:   merkleRoot,
+		MerkleChunks: merkleChunks,
+		ChunkStats:   timings.stats(),
+	}, nil
+}
@@ -1,3 +1,3 @@
-module main.go
+module github.com/reethikar/multi-source-downloader
 
-go 1.15
+go 1.21
@@ -1,111 +1,401 @@
 package main
 
 import (
-	"crypto/sha256"
+	"bufio"
+	"bytes"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
 	"io"
-	"log"
+	"log/slog"
+	"math"
+	"net"
 	"net/http"
 	"net/url"
-	"strings"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"sort"
 	"strconv"
-	"sync"
+	"strings"
+	"syscall"
 	"time"
-	"os"
+
+	"github.com/reethikar/multi-source-downloader/downloader"
 )
 
-// confirmSupportAndFileChunkSize tests to see if "Accept-Ranges" is part of the HTTP Response header
-// If HTTP Range requests are not supported, return server not supported error
-// If supported, return the filesize and anticipated chunkSize
-func confirmSupportAndFileChunkSize(dwLink string, defaultNumChunks uint) (int64, int64, error) {
-	// Set DisableCompression to true (default is false) 
-	// This ensures Go's internal transport behavior does not mess with our logic
-	tr := &http.Transport{
-		DisableCompression: true,
-	}
-	client := &http.Client{Transport: tr}
-	response, err := client.Head(dwLink)
+// headerFlags implements flag.Value for the repeatable -H "Name: Value" flag
+type headerFlags http.Header
+
+func (h headerFlags) String() string {
+	var headers []string
+	for name, values := range h {
+		for _, value := range values {
+			headers = append(headers, name+": "+value)
+		}
+	}
+	return strings.Join(headers, ", ")
+}
+
+// Set parses "Name: Value", splitting on the first colon only so that values may contain colons
+func (h headerFlags) Set(value string) error {
+	parts := strings.SplitN(value, ":", 2)
+	if len(parts) != 2 || strings.TrimSpace(parts[0]) == "" {
+		return fmt.Errorf("header %q is not in the \"Name: Value\" format", value)
+	}
+	http.Header(h).Add(strings.TrimSpace(parts[0]), strings.TrimSpace(parts[1]))
+	return nil
+}
+
+// cookieFlags implements flag.Value for the repeatable -cookie "name=value; name2=value2" flag
+type cookieFlags []*http.Cookie
+
+func (c *cookieFlags) String() string {
+	cookies := make([]string, 0, len(*c))
+	for _, cookie := range *c {
+		cookies = append(cookies, cookie.String())
+	}
+	return strings.Join(cookies, "; ")
+}
+
+// Set parses the cookies the way a server parses a Cookie header
+func (c *cookieFlags) Set(value string) error {
+	parts := 0
+	for _, part := range strings.Split(value, ";") {
+		if part = strings.TrimSpace(part); part == "" {
+			continue
+		}
+		if name, _, ok := strings.Cut(part, "="); !ok || name == "" {
+			return fmt.Errorf("cookie %q is not in the \"name=value; name2=value2\" format", part)
+		}
+		parts++
+	}
+	cookies := (&http.Request{Header: http.Header{"Cookie": {value}}}).Cookies()
+	if parts == 0 || len(cookies) != parts {
+		return fmt.Errorf("cookies %q are not in the \"name=value; name2=value2\" format", value)
+	}
+	*c = append(*c, cookies...)
+	return nil
+}
+
+// listFlags implements flag.Value for a flag that can be repeated or given a comma-separated list
+type listFlags []string
+
+func (l *listFlags) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *listFlags) Set(value string) error {
+	for _, item := range strings.Split(value, ",") {
+		if item = strings.TrimSpace(item); item != "" {
+			*l = append(*l, item)
+		}
+	}
+	return nil
+}
+
+// sizeUnits are the suffixes parseSize accepts, longer ones first so that "kB" is not taken for "B"
+var sizeUnits = []struct {
+	suffix     string
+	multiplier float64
+}{
+	{"KiB", 1 << 10}, {"MiB", 1 << 20}, {"GiB", 1 << 30}, {"TiB", 1 << 40},
+	{"kB", 1e3}, {"KB", 1e3}, {"MB", 1e6}, {"GB", 1e9}, {"TB", 1e12},
+	{"k", 1 << 10}, {"K", 1 << 10}, {"m", 1 << 20}, {"M", 1 << 20}, {"g", 1 << 30}, {"G", 1 << 30}, {"t", 1 << 40}, {"T", 1 << 40},
+	{"B", 1},
+}
+
+// parseSize parses a number of bytes such as "512", "64k", "10M" or "1.5G"
+// The single letter suffixes k, M, G and T are binary (1024) based as in curl and wget, like KiB, MiB, GiB and TiB,
+// while kB, MB, GB and TB are decimal (1000) based
+func parseSize(value string) (int64, error) {
+	number, multiplier := value, 1.0
+	for _, unit := range sizeUnits {
+		if strings.HasSuffix(value, unit.suffix) {
+			number, multiplier = strings.TrimSuffix(value, unit.suffix), unit.multiplier
+			break
+		}
+	}
+	count, err := strconv.ParseFloat(number, 64)
+	// count != count is true for NaN
+	if err != nil || count < 0 || count != count {
+		return 0, fmt.Errorf("%q is not a number of bytes, such as 512, 64k or 1.5G", value)
+	}
+	size := count * multiplier
+	if size >= math.MaxInt64 {
+		return 0, fmt.Errorf("%q is too large", value)
+	}
+	return int64(size), nil
+}
+
+// sizeFlag is a flag for a number of bytes parsed by parseSize
+type sizeFlag int64
+
+func (s *sizeFlag) String() string {
+	return strconv.FormatInt(int64(*s), 10)
+}
+
+func (s *sizeFlag) Set(value string) error {
+	size, err := parseSize(value)
+	if err != nil {
+		return err
+	}
+	*s = sizeFlag(size)
+	return nil
+}
+
+// jsonSummary is printed to stdout on completion with -json
+type jsonSummary struct {
+	URL        string `json:"url"`
+	Output     string `json:"output"`
+	Bytes      int64  `json:"bytes"`
+	Chunks     int64  `json:"chunks"`
+	DurationMs int64  `json:"duration_ms"`
+	// AvgMbps is the average speed in megabits per second
+	AvgMbps      float64           `json:"avg_mbps"`
+	SHA256       string            `json:"sha256,omitempty"`
+	Checksums    map[string]string `json:"checksums,omitempty"`
+	MerkleRoot   string            `json:"merkle_root,omitempty"`
+	MerkleChunks int64             `json:"merkle_chunks,omitempty"`
+}
+
+// jsonRemoteInfo is printed to stdout with -head-only and -json
+type jsonRemoteInfo struct {
+	URL      string `json:"url"`
+	FinalURL string `json:"final_url"`
+	// Size is null if the server did not report it
+	Size          *int64 `json:"size"`
+	AcceptsRanges bool   `json:"accepts_ranges"`
+	Filename      string `json:"filename"`
+	ContentType   string `json:"content_type,omitempty"`
+	ETag          string `json:"etag,omitempty"`
+	LastModified  string `json:"last_modified,omitempty"`
+}
+
+// newJSONRemoteInfo returns what the server reports about the file at dwLink
+func newJSONRemoteInfo(dwLink string, remote *downloader.RemoteInfo) jsonRemoteInfo {
+	info := jsonRemoteInfo{
+		URL:           dwLink,
+		FinalURL:      remote.FinalURL,
+		AcceptsRanges: remote.AcceptsRanges,
+		Filename:      remote.ResolvedFilename,
+		ContentType:   remote.ContentType,
+		ETag:          remote.ETag,
+		LastModified:  remote.LastModified,
+	}
+	if remote.Size > 0 || remote.AcceptsRanges {
+		info.Size = &remote.Size
+	}
+	return info
+}
+
+// newJSONSummary returns the summary of a completed download of dwLink
+func newJSONSummary(dwLink string, result *downloader.Result) jsonSummary {
+	summary := jsonSummary{
+		URL:        dwLink,
+		Output:     result.Path,
+		Bytes:      result.Bytes,
+		Chunks:     result.Chunks,
+		DurationMs: result.Elapsed.Milliseconds(),
+		SHA256:     hex.EncodeToString(result.SHA256),
+		Checksums:  map[string]string{},
+		MerkleRoot: hex.EncodeToString(result.MerkleRoot),
+	}
+	if result.MerkleRoot != nil {
+		summary.MerkleChunks = result.MerkleChunks
+	}
+	if seconds := result.Elapsed.Seconds(); seconds > 0 {
+		summary.AvgMbps = float64(result.Bytes) * 8 / 1e6 / seconds
+	}
+	for algorithm, checksum := range result.Checksums {
+		summary.Checksums[algorithm] = hex.EncodeToString(checksum)
+	}
+	return summary
+}
+
+// parseStatuses parses a comma-separated list of HTTP statuses, which must be 4xx or 5xx
+func parseStatuses(list string) ([]int, error) {
+	var statuses []int
+	for _, field := range strings.Split(list, ",") {
+		status, err := strconv.Atoi(strings.TrimSpace(field))
+		if err != nil || status < 400 || status > 599 {
+			return nil, fmt.Errorf("%q is not a 4xx or 5xx HTTP status", field)
+		}
+		statuses = append(statuses, status)
+	}
+	return statuses, nil
+}
+
+// joinInts returns values as a comma-separated list
+func joinInts(values []int) string {
+	fields := make([]string, len(values))
+	for i, value := range values {
+		fields[i] = strconv.Itoa(value)
+	}
+	return strings.Join(fields, ",")
+}
+
+// parseSourceIP parses the IP address to connect from and checks that it is assigned to this machine,
+// by binding a UDP socket to it, which does not send anything
+func parseSourceIP(address string) (net.IP, error) {
+	ip := net.ParseIP(address)
+	if ip == nil {
+		return nil, fmt.Errorf("%q is not an IP address", address)
+	}
+	conn, err := net.ListenPacket("udp", net.JoinHostPort(ip.String(), "0"))
+	if err != nil {
+		return nil, fmt.Errorf("%s is not an address of this machine: %w", address, err)
+	}
+	conn.Close()
+	return ip, nil
+}
+
+// loadCertPool returns a pool of the PEM encoded certificates in the file at path
+func loadCertPool(path string) (*x509.CertPool, error) {
+	pem, err := os.ReadFile(path)
 	if err != nil {
-    		log.Println(err)
-		return 0, 0, errors.New("HTTP error: GET request failed")
+		return nil, err
+	}
+	pool := x509.NewCertPool()
+	if !pool.AppendCertsFromPEM(pem) {
+		return nil, fmt.Errorf("%s does not contain any valid PEM encoded certificate", path)
+	}
+	return pool, nil
+}
+
+// readPassword returns the password from the first line of stdin if fromStdin is set,
+// or from the environment variable envName if that is set, so it does not show up in shell history
+func readPassword(fromStdin bool, envName string) (string, error) {
+	if fromStdin {
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && err != io.EOF {
+			return "", err
+		}
+		return strings.TrimRight(line, "\r\n"), nil
 	}
-	acceptRanges := response.Header["Accept-Ranges"]
-	if len(acceptRanges) == 0  || acceptRanges[0] == "none" {
-		return 0, 0, errors.New("Server Error: Accept-Ranges Header does not exist in HTTP Response")
+	password, found := os.LookupEnv(envName)
+	if !found {
+		return "", fmt.Errorf("environment variable %s is not set", envName)
 	}
-	filesize, err := strconv.ParseInt(response.Header["Content-Length"][0], 10, 64)
-	return filesize, (filesize/int64(defaultNumChunks)), err
+	return password, nil
 }
 
-// getDownloadFileName returns the filename of the file hosted at the URL to download
-func getDownloadFileName(dwLink string) string {
-	filename, err := url.Parse(dwLink)
+// netrcPath returns the netrc file to take credentials from: the NETRC environment variable if it is set,
+// otherwise ~/.netrc if it exists, or "" if there is none
+func netrcPath() string {
+	if path, found := os.LookupEnv("NETRC"); found {
+		return path
+	}
+	home, err := os.UserHomeDir()
 	if err != nil {
-		log.Println(err)
 		return ""
 	}
-	urlParts := strings.Split(filename.Path, "/")
-	filePart := strings.Split(urlParts[len(urlParts)-1], "?")
-	return filePart[0]
+	path := filepath.Join(home, ".netrc")
+	if _, err := os.Stat(path); err != nil {
+		return ""
+	}
+	return path
 }
 
-// getObjectRange obtains the range of bytes from rangeStart to rangeEnd from the server using the Range HTTP request header
-// returns the HTTP response
-func getObjectRange(dwLink string, rangeStart int64, rangeEnd int64) (http.Response, error) {
-	// Set DisableCompression manually to true, same reason as in confirmSupportAndFileChunkSize
-	tr := &http.Transport{
-		DisableCompression: true,
+// localFileURL returns the file:// URL of path if it is an existing local file rather than a URL
+func localFileURL(path string) (string, bool) {
+	if strings.Contains(path, "://") {
+		return "", false
+	}
+	info, err := os.Stat(path)
+	if err != nil || info.IsDir() {
+		return "", false
 	}
-	client := &http.Client{Transport: tr}
-	craftRequest, err := http.NewRequest("GET", dwLink, nil)
+	abs, err := filepath.Abs(path)
 	if err != nil {
-		return http.Response{}, err
+		return "", false
 	}
-	craftRequest.Header.Add("Range", fmt.Sprintf("bytes=%d-%d", rangeStart, rangeEnd))
-	response, err := client.Do(craftRequest)
+	return (&url.URL{Scheme: "file", Path: filepath.ToSlash(abs)}).String(), true
+}
+
+// checkURL returns an error if dwLink is not an http, https or file URL, or an http or https URL without a host
+func checkURL(dwLink string) error {
+	parsed, err := url.Parse(dwLink)
 	if err != nil {
-		return http.Response{}, err
-	}
-	return *response, err
-}
-
-// writeChunks writes the obtained object to the right position in the file
-func writeChunks(response http.Response, fileToWrite *os.File, currChunk uint, rangeStart int64, downloaderWg *sync.WaitGroup) {
-	var writeRangeStart = rangeStart
-	// Obtain size of response to compare the bytes read from the object
-	responseSize, _ := strconv.ParseInt(response.Header["Content-Length"][0], 10, 64)
-
-	obj := response.Body
-	defer obj.Close()
-	defer downloaderWg.Done()
-	
-	// make a temporary buffer to read chunks from the response
-	buff := make([]byte, 8*1024)
-	for {
-		bytesRead, readErr := obj.Read(buff)
-		if bytesRead > 0 {
-			bytesWritten, writeErr := fileToWrite.WriteAt(buff[0:bytesRead], writeRangeStart)
-			writeRangeStart += int64(bytesWritten)
-			if writeErr != nil {
-				log.Fatalf("Error: %s, at chunk: %d.\n", writeErr.Error(), currChunk)
-			}
-			if bytesRead != bytesWritten {
-				log.Fatalln("Error occurred during writing, bytes read and bytes written do not match. At chunk: ", currChunk)
-			}
+		return err
+	}
+	switch parsed.Scheme {
+	case "http", "https":
+		if parsed.Host == "" {
+			return fmt.Errorf("%s has no host", dwLink)
+		}
+	case "file":
+	case "":
+		return fmt.Errorf("%s has no scheme and is not an existing file, use an http, https or file URL", dwLink)
+	default:
+		return fmt.Errorf("%s has the unsupported scheme %q, use an http, https or file URL", dwLink, parsed.Scheme)
+	}
+	return nil
+}
+
+// loadConfig sets the flags from the JSON object in the file at path, keyed by flag name,
+// e.g. {"chunks": 8, "H": ["X-API-Key: secret"]}, flags passed on the command line take precedence
+// Arrays set repeatable flags such as -H and -mirror once per element
+func loadConfig(path string) error {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return err
+	}
+	decoder := json.NewDecoder(bytes.NewReader(data))
+	decoder.UseNumber()
+	var config map[string]interface{}
+	if err := decoder.Decode(&config); err != nil {
+		return fmt.Errorf("%s is not a JSON object: %w", path, err)
+	}
+	names := make([]string, 0, len(config))
+	for name := range config {
+		names = append(names, name)
+	}
+	// Sorted so that the first unknown key reported is the same on every run
+	sort.Strings(names)
+	for _, name := range names {
+		if flag.Lookup(name) == nil || name == "config" {
+			return fmt.Errorf("unknown option %q in %s", name, path)
 		}
-		if readErr != nil && readErr.Error() == "EOF" {
-			if responseSize == (writeRangeStart-rangeStart) {
-				fmt.Println("Downloaded chunk ", currChunk+1, " successfully!")
-			} else {
-				log.Fatalf("Error during READ, but reached EOF : %s\n", readErr.Error())
+		if isFlagPassed(name) {
+			continue
+		}
+		values, isArray := config[name].([]interface{})
+		if !isArray {
+			values = []interface{}{config[name]}
+		}
+		for _, value := range values {
+			switch value.(type) {
+			case string, bool, json.Number:
+			default:
+				return fmt.Errorf("option %q in %s must be a string, number or boolean, or an array of them", name, path)
+			}
+			if err := flag.Set(name, fmt.Sprint(value)); err != nil {
+				return fmt.Errorf("option %q in %s: %w", name, path, err)
 			}
-			break
-		} else if readErr != nil {
-			log.Fatalf("Error during READ: %s, in chunk: %d.\n", readErr.Error(), currChunk)
 		}
 	}
+	return nil
+}
+
+// isTerminal checks if f is a terminal rather than a file or pipe
+func isTerminal(f *os.File) bool {
+	info, err := f.Stat()
+	return err == nil && info.Mode()&os.ModeCharDevice != 0
+}
+
+// confirmOverwrite asks on stderr whether to overwrite the existing file at path, and reads the answer from stdin
+func confirmOverwrite(path string) bool {
+	fmt.Fprintf(os.Stderr, "%s exists, overwrite? [y/N] ", path)
+	answer, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	answer = strings.ToLower(strings.TrimSpace(answer))
+	return answer == "y" || answer == "yes"
 }
 
 // isFlagPassed checks if the input flag string was passed explicitly by user
@@ -120,63 +410,740 @@ func isFlagPassed(name string) bool {
 }
 
 func main() {
+	if err := run(); err != nil {
+		slog.Error(err.Error())
+		var exitErr *exitError
+		if errors.As(err, &exitErr) {
+			os.Exit(exitErr.code)
+		}
+		os.Exit(1)
+	}
+}
+
+// exitError is returned by run to exit with a status other than 1
+type exitError struct {
+	code int
+	err  error
+}
+
+func (e *exitError) Error() string {
+	return e.err.Error()
+}
+
+func (e *exitError) Unwrap() error {
+	return e.err
+}
+
+// run parses the flags and downloads the file, or every file of -urls-file, main logs the returned error
+func run() error {
 	// Get URL to download and desired output file name
-	var resultFile, dwLink string
-	var defaultNumChunks uint
+	var resultFile string
+	var passwordStdin bool
+	var passwordEnv string
+	d := downloader.Downloader{Header: http.Header{}, Log: os.Stdout}
 	// SHA256 Checksum for https://go.dev/dl/go1.20.3.linux-amd64.tar.gz file from https://go.dev/dl/ is 979694c2c25c735755bf26f4f45e19e64e4811d661dd07b8c010f7a8e18adfca (4/5/23)
-	flag.StringVar(&dwLink, "url", "https://go.dev/dl/go1.20.3.linux-amd64.tar.gz", "URL of the file to download (default: latest go release for linux as of 4/5/23)")
-	flag.StringVar(&resultFile, "output", "", "Path and filename to save output file (default: current directory with filename obtained through the URL)")
-	flag.UintVar(&defaultNumChunks, "parallel", 10, "Number of chunks to download in parallel, type uint (default: 10)")
-	flag.Parse()
+	flag.StringVar(&d.URL, "url", "https://go.dev/dl/go1.20.3.linux-amd64.tar.gz", "URL of the file to download, or the path or file:// URL of a local file to copy (default: latest go release for linux as of 4/5/23)")
+	flag.StringVar(&resultFile, "output", "", "Path and filename to save output file, - for stdout (default: current directory with filename obtained through the URL)")
+	flag.StringVar(&d.OutputDir, "output-dir", "", "Directory to save the output file in, created if it does not exist (default: current directory)")
+	flag.StringVar(&d.FilenameTemplate, "filename-template", "", "Name the file from a template when -output is not set, e.g. {basename}-{date}.{ext}, with {basename}, {ext}, {date}, {host} and {sha256-short}")
+	flag.BoolVar(&d.DetectExtension, "detect-extension", false, "Append the extension of the Content-Type to the filename when -output is not set and it does not already have one of its extensions, e.g. .gz for application/gzip")
+	flag.Int64Var(&d.Chunks, "chunks", 0, "Number of chunks to split the file into (default: one per 16 MiB of the file, at most 256)")
+	// -parallel is kept as an alias of -chunks so existing invocations keep working
+	flag.Int64Var(&d.Chunks, "parallel", 0, "Alias for -chunks")
+	flag.BoolVar(&d.Overwrite, "overwrite", false, "Replace the output file if it already exists, instead of failing or asking when run in a terminal")
+	var rangeEnd int64
+	flag.Var((*sizeFlag)(&d.RangeStart), "range-start", "Offset of the first byte of the remote file to download, e.g. 4096 or 1M, the range is saved at the start of the output")
+	flag.Var((*sizeFlag)(&rangeEnd), "range-end", "Offset of the last byte of the remote file to download, inclusive (default: the end of the file)")
+	flag.BoolVar(&d.SkipSpaceCheck, "skip-space-check", false, "Download even if the filesystem of the output file does not seem to have room for it")
+	flag.BoolVar(&d.DryRun, "dry-run", false, "Only check the server and print the resolved URL, size, output path and chunk ranges, without downloading")
+	var headOnly bool
+	flag.BoolVar(&headOnly, "head-only", false, "Only check the server and print what it reports about the file (URL, size, range support, ETag, filename), then exit")
+	var fileMode string
+	flag.StringVar(&fileMode, "mode", "", "Octal permissions of the output file, e.g. 0755 or 0600 (default: 0666 before the umask)")
+	flag.BoolVar(&d.Resume, "continue", false, "Download to <output>.part and resume from it if it already exists")
+	flag.BoolVar(&d.ResumeVerify, "resume-verify", false, "Verify the completed chunks of the .part file against the checksums in its manifest before resuming, and download the corrupt ones again, implies -continue")
+	flag.Int64Var(&d.MaxConcurrent, "maxConcurrent", 0, "Maximum number of chunks downloaded at the same time (default: same as -chunks if set, 10 otherwise)")
+	flag.IntVar(&d.RangesPerRequest, "ranges-per-request", 1, "Request up to this many chunks in a single multi-range request, falling back to one per request if the server does not support it")
+	flag.BoolVar(&d.AcceptEncoding, "accept-encoding", false, "Accept a gzip or deflate compressed response in a single stream download, and decompress it on the fly")
+	flag.BoolVar(&d.SlowStart, "slow-start", false, "Start with 2 chunks at the same time and double them every 2s up to -maxConcurrent while the throughput improves")
+	flag.DurationVar(&d.Stagger, "stagger", 0, "Minimum delay between starting two chunk requests, e.g. 100ms, so that a rate-limited server is not hit by all of them at once (default: no delay)")
+	flag.IntVar(&d.Retries, "retries", 3, "Number of times a failed chunk request is retried with exponential backoff (default: 3)")
+	flag.IntVar(&d.RetryPasses, "retry-passes", 1, "Number of further passes over the chunks that still failed after their retries (default: 1)")
+	var retryOn string
+	flag.StringVar(&retryOn, "retry-on", joinInts(downloader.DefaultRetryOn), "Comma-separated HTTP statuses of a chunk request that are retried, any other fails the chunk right away, e.g. 429,500,502,503,504,520")
+	flag.StringVar(&d.User, "user", "", "Username for HTTP Basic auth")
+	flag.StringVar(&d.Password, "password", "", "Password for HTTP Basic auth")
+	flag.BoolVar(&passwordStdin, "password-stdin", false, "Read the HTTP Basic auth password from the first line of stdin")
+	flag.StringVar(&passwordEnv, "password-env", "", "Read the HTTP Basic auth password from the given environment variable")
+	flag.Var(headerFlags(d.Header), "H", "Custom request header in the \"Name: Value\" format, can be repeated")
+	flag.StringVar(&d.UserAgent, "user-agent", downloader.DefaultUserAgent, "User-Agent header sent with every request")
+	flag.StringVar(&d.BearerToken, "bearer", "", "Token sent as \"Authorization: Bearer <token>\" header")
+	flag.Var((*cookieFlags)(&d.Cookies), "cookie", "Cookies sent with every request in the \"name=value; name2=value2\" format, can be repeated")
+	flag.StringVar(&d.CookieFile, "cookie-file", "", "Cookie file in the Netscape format of curl and wget, whose cookies are sent to the hosts they are set for")
+	var hashes, expected, expectedSHA256 string
+	flag.StringVar(&hashes, "hash", downloader.DefaultHash, "Comma-separated checksum algorithms to calculate: md5, sha1, sha256, sha512 or crc32")
+	flag.StringVar(&expected, "expected", "", "Fail if the checksum of the first -hash algorithm does not match this hex encoded value")
+	flag.StringVar(&expectedSHA256, "expected-sha256", "", "Fail if the SHA256 checksum of the downloaded file does not match this hex encoded value")
+	flag.BoolVar(&d.NoChecksum, "no-checksum", false, "Skip calculating the checksum of the downloaded file")
+	flag.BoolVar(&d.VerifySidecar, "verify-sidecar", false, "Verify the SHA256 checksum against the one listed in the <url>.sha256 file published next to the file")
+	flag.BoolVar(&d.Merkle, "merkle", false, "Print a Merkle root over the SHA256 checksums of the chunks, hashed while downloading, instead of the checksum of the file")
+	flag.Var((*listFlags)(&d.Mirrors), "mirror", "URL of a mirror serving the same file, can be repeated or comma-separated")
+	bufferSize := int64(downloader.DefaultBufferSize)
+	flag.Var((*sizeFlag)(&bufferSize), "buffer-size", "Size of the buffer each chunk reads the response into, e.g. 64k or 1M (default: 64k)")
+	flag.Var((*sizeFlag)(&d.RateLimit), "limit-rate", "Maximum download rate in bytes per second across all chunks, e.g. 500k or 2M (default: unlimited)")
+	flag.DurationVar(&d.Timeout, "timeout", 0, "Maximum time for downloading a single chunk, e.g. 30s or 5m, a chunk that times out is retried (default: no timeout)")
+	var deadline time.Duration
+	flag.DurationVar(&deadline, "deadline", 0, "Abort the whole download if it has not finished after this long, e.g. 5m, exiting with status 124 (default: no deadline)")
+	flag.DurationVar(&d.StallTimeout, "stall-timeout", 0, "Abort a chunk if no bytes arrive for this long, e.g. 20s, a stalled chunk is retried (default: no timeout)")
+	flag.BoolVar(&d.FailFast, "fail-fast", false, "Stop all chunks as soon as one of them fails (default: attempt every chunk and report all failures)")
+	var maxRedirects int
+	flag.IntVar(&maxRedirects, "max-redirects", downloader.DefaultMaxRedirects, "Maximum number of redirects followed for a request, 0 to fail on a redirect instead")
+	flag.BoolVar(&d.HTTP1, "http1", false, "Force HTTP/1.1, e.g. for servers with buggy HTTP/2 range handling (default: HTTP/2 if the server supports it)")
+	flag.BoolVar(&d.InsecureSkipVerify, "insecure", false, "Skip the verification of the server's TLS certificate, e.g. for self-signed certificates")
+	var proxy string
+	flag.StringVar(&proxy, "proxy", "", "Proxy URL for all requests, e.g. http://proxy:3128 (default: from the HTTP_PROXY, HTTPS_PROXY and NO_PROXY environment variables)")
+	var clientCert, clientKey string
+	flag.StringVar(&clientCert, "client-cert", "", "PEM file with the TLS client certificate to present to the server, e.g. for an mTLS protected registry, requires -client-key")
+	flag.StringVar(&clientKey, "client-key", "", "PEM file with the private key of -client-cert")
+	var sourceIP string
+	flag.StringVar(&sourceIP, "source-ip", "", "Local IP address to connect from, e.g. to pick the network interface on a multi-homed machine")
+	var prefer string
+	flag.StringVar(&prefer, "prefer", "auto", "IP version to connect over: ipv4, ipv6, or auto to use whichever connects first")
+	var caCert string
+	flag.StringVar(&caCert, "cacert", "", "PEM file with the certificate authorities to trust for the server's TLS certificate instead of the system ones")
+	var quiet, verbose, jsonOutput bool
+	flag.BoolVar(&jsonOutput, "json", false, "Print only a JSON summary of the download to stdout, progress messages go to stderr")
+	flag.BoolVar(&quiet, "quiet", false, "Print nothing but errors")
+	flag.BoolVar(&verbose, "verbose", false, "Also print every request with its range, protocol, status and bytes received")
+	var logFormat string
+	flag.StringVar(&logFormat, "log-format", "plain", "Format of the messages: plain with a progress line, or text or json for one structured record per message on stderr, e.g. for log aggregation")
+	var checksumFile string
+	flag.StringVar(&checksumFile, "checksum-file", "", "Append the checksums of the -hash algorithms to this file in the sha256sum format, for later verification with sha256sum -c")
+	var throughputLog string
+	flag.StringVar(&throughputLog, "throughput-log", "", "Write a histogram of the bytes downloaded every second to this file once done, - to print it with the other messages")
+	var postHook string
+	flag.StringVar(&postHook, "post-hook", "", "Shell command to run after a successful, verified download, with MSD_OUTPUT, MSD_SIZE, MSD_URL and MSD_SHA256 set, its exit status becomes the program's")
+	var extract bool
+	flag.BoolVar(&extract, "extract", false, "Extract the file after a successful, verified download if it is a tar, tar.gz or zip archive")
+	var extractDir string
+	flag.StringVar(&extractDir, "extract-dir", "", "Directory to extract the archive into, implies -extract (default: the directory of the downloaded file)")
+	var urlsFile string
+	flag.StringVar(&urlsFile, "urls-file", "", "File with one URL to download per line, blank lines and # comments are skipped")
+	var configPath string
+	flag.StringVar(&configPath, "config", "", "JSON file with default values for the other flags, keyed by flag name, e.g. {\"chunks\": 8}")
+	// An invalid flag exits with 1 like any other Bad Input, 2 is the exit status of a checksum mismatch
+	flag.CommandLine.Init(os.Args[0], flag.ContinueOnError)
+	if err := flag.CommandLine.Parse(os.Args[1:]); err != nil {
+		if errors.Is(err, flag.ErrHelp) {
+			return nil
+		}
+		return fmt.Errorf("Bad Input: %w", err)
+	}
+
+	if configPath != "" {
+		if err := loadConfig(configPath); err != nil {
+			return fmt.Errorf("Bad Input: -config %w", err)
+		}
+	}
+	if fileURL, ok := localFileURL(d.URL); ok {
+		d.URL = fileURL
+	}
+	if d.URL != "" {
+		if err := checkURL(d.URL); err != nil {
+			return fmt.Errorf("Bad Input: -url %w", err)
+		}
+	}
+	for _, mirror := range d.Mirrors {
+		if err := checkURL(mirror); err != nil {
+			return fmt.Errorf("Bad Input: -mirror %w", err)
+		}
+	}
+	// out receives the results of the download, the errors are logged to stderr regardless
+	var out io.Writer = os.Stdout
+	level := slog.LevelInfo
+	switch {
+	case quiet && verbose:
+		return errors.New("Bad Input: -quiet cannot be combined with -verbose")
+	case quiet:
+		d.LogLevel = downloader.LogQuiet
+		level = slog.LevelError
+		out = io.Discard
+	case verbose:
+		d.LogLevel = downloader.LogVerbose
+		level = slog.LevelDebug
+	}
+	// The plain format keeps the default logger, which writes the errors to stderr through the log package
+	switch logFormat {
+	case "plain":
+	case "text":
+		d.Logger = slog.New(slog.NewTextHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	case "json":
+		d.Logger = slog.New(slog.NewJSONHandler(os.Stderr, &slog.HandlerOptions{Level: level}))
+	default:
+		return fmt.Errorf("Bad Input: -log-format must be plain, text or json, got %q", logFormat)
+	}
+	if d.Logger != nil {
+		slog.SetDefault(d.Logger)
+	}
+	if jsonOutput {
+		// stdout only gets the JSON summary, so that it can be parsed
+		d.Log = os.Stderr
+		out = io.Discard
+	}
+	if proxy != "" {
+		proxyURL, err := url.Parse(proxy)
+		if err != nil || proxyURL.Host == "" {
+			return fmt.Errorf("Bad Input: -proxy must be a URL such as http://proxy:3128, got %s", proxy)
+		}
+		d.Proxy = proxyURL
+	}
+	switch prefer {
+	case "auto":
+	case "ipv4":
+		d.IPFamily = downloader.IPv4
+	case "ipv6":
+		d.IPFamily = downloader.IPv6
+	default:
+		return fmt.Errorf("Bad Input: -prefer must be ipv4, ipv6 or auto, got %q", prefer)
+	}
+	if sourceIP != "" {
+		ip, err := parseSourceIP(sourceIP)
+		if err != nil {
+			return fmt.Errorf("Bad Input: -source-ip %w", err)
+		}
+		d.SourceIP = ip
+	}
+	if caCert != "" {
+		pool, err := loadCertPool(caCert)
+		if err != nil {
+			return fmt.Errorf("Bad Input: could not load -cacert: %w", err)
+		}
+		d.RootCAs = pool
+	}
+	if (clientCert == "") != (clientKey == "") {
+		return errors.New("Bad Input: -client-cert and -client-key must be used together")
+	}
+	if clientCert != "" {
+		certificate, err := tls.LoadX509KeyPair(clientCert, clientKey)
+		if err != nil {
+			return fmt.Errorf("Bad Input: could not load -client-cert and -client-key: %w", err)
+		}
+		d.ClientCertificates = []tls.Certificate{certificate}
+	}
+	if d.InsecureSkipVerify {
+		slog.Warn("TLS certificate verification is disabled (-insecure), the server's identity is not checked")
+	}
+	if isFlagPassed("chunks") || isFlagPassed("parallel") {
+		if d.Chunks < 1 {
+			return fmt.Errorf("Bad Input: number of chunks must be at least 1, got %d", d.Chunks)
+		}
+	}
+	statuses, err := parseStatuses(retryOn)
+	if err != nil {
+		return fmt.Errorf("Bad Input: -retry-on %w", err)
+	}
+	d.RetryOn = statuses
+	if d.BearerToken != "" && d.User != "" {
+		return errors.New("Bad Input: -bearer cannot be combined with -user")
+	}
+	if passwordStdin || passwordEnv != "" {
+		if d.Password != "" || (passwordStdin && passwordEnv != "") {
+			return errors.New("Bad Input: only one of -password, -password-stdin and -password-env can be used")
+		}
+		password, err := readPassword(passwordStdin, passwordEnv)
+		if err != nil {
+			return fmt.Errorf("Bad Input: could not read password: %w", err)
+		}
+		d.Password = password
+	}
+	if d.BearerToken == "" && d.User == "" && d.Header.Get("Authorization") == "" {
+		d.Netrc = netrcPath()
+	}
+	d.Hashes = strings.Split(hashes, ",")
+	d.Expected = map[string]string{}
+	if d.Merkle && isFlagPassed("hash") {
+		return errors.New("Bad Input: -merkle cannot be combined with -hash, the Merkle root is always calculated with SHA256")
+	}
+	if d.Merkle {
+		// -expected is the Merkle root, the checksum of the file is not calculated
+		d.ExpectedMerkleRoot = expected
+	} else if expected != "" {
+		d.Expected[d.Hashes[0]] = expected
+	}
+	if expectedSHA256 != "" {
+		if _, found := d.Expected["sha256"]; found {
+			return errors.New("Bad Input: -expected-sha256 cannot be combined with -expected for -hash=sha256")
+		}
+		d.Expected["sha256"] = expectedSHA256
+	}
+	if isFlagPassed("range-end") {
+		if rangeEnd < d.RangeStart {
+			return fmt.Errorf("Bad Input: -range-end %d is before -range-start %d", rangeEnd, d.RangeStart)
+		}
+		d.RangeLength = rangeEnd - d.RangeStart + 1
+	}
+	if fileMode != "" {
+		mode, err := strconv.ParseUint(fileMode, 8, 32)
+		if err != nil || mode == 0 || mode > 0777 {
+			return fmt.Errorf("Bad Input: -mode %q is not an octal permission such as 0755 or 0600", fileMode)
+		}
+		d.FileMode = os.FileMode(mode)
+	}
+	if bufferSize < 1 {
+		return fmt.Errorf("Bad Input: -buffer-size must be at least 1 byte, got %d", bufferSize)
+	}
+	d.BufferSize = int(bufferSize)
+	if maxRedirects < 0 {
+		return fmt.Errorf("Bad Input: -max-redirects cannot be negative, got %d", maxRedirects)
+	}
+	if d.ResumeVerify {
+		d.Resume = true
+	}
+	d.MaxRedirects = maxRedirects
+	if maxRedirects == 0 {
+		d.NoRedirects = true
+	}
+	if deadline < 0 {
+		return fmt.Errorf("Bad Input: -deadline cannot be negative, got %s", deadline)
+	}
+	if isFlagPassed("limit-rate") && d.RateLimit < 1 {
+		return fmt.Errorf("Bad Input: -limit-rate must be at least 1 byte per second, got %d", d.RateLimit)
+	}
+	if urlsFile != "" && (isFlagPassed("url") || isFlagPassed("output") || len(d.Expected) > 0 || d.ExpectedMerkleRoot != "" || len(d.Mirrors) > 0) {
+		return errors.New("Bad Input: -urls-file cannot be combined with -url, -output, -expected, -expected-sha256 or -mirror, which only apply to a single file")
+	}
+	if d.DetectExtension && isFlagPassed("output") {
+		return errors.New("Bad Input: -detect-extension cannot be combined with -output")
+	}
+	if d.FilenameTemplate != "" {
+		if isFlagPassed("output") {
+			return errors.New("Bad Input: -filename-template cannot be combined with -output")
+		}
+		if err := downloader.CheckFilenameTemplate(d.FilenameTemplate); err != nil {
+			return fmt.Errorf("Bad Input: -filename-template: %w", err)
+		}
+	}
+	if postHook != "" && (resultFile == "-" || d.DryRun) {
+		return errors.New("Bad Input: -post-hook cannot be combined with -output=- or -dry-run")
+	}
+	if extractDir != "" {
+		extract = true
+	}
+	if extract && (resultFile == "-" || d.DryRun) {
+		return errors.New("Bad Input: -extract cannot be combined with -output=- or -dry-run")
+	}
+	if checksumFile != "" && (resultFile == "-" || d.NoChecksum || d.Merkle || d.DryRun) {
+		return errors.New("Bad Input: -checksum-file cannot be combined with -output=-, -no-checksum, -merkle or -dry-run")
+	}
+	if headOnly && (urlsFile != "" || isFlagPassed("output") || d.DryRun) {
+		return errors.New("Bad Input: -head-only cannot be combined with -urls-file, -output or -dry-run")
+	}
+	if resultFile == "-" && jsonOutput {
+		return errors.New("Bad Input: -json cannot be combined with -output=- as both write to stdout")
+	}
+	if resultFile == "-" {
+		// stdout only gets the file, so that it can be piped into another program
+		d.Writer = os.Stdout
+		d.Log = os.Stderr
+		if out == os.Stdout {
+			out = os.Stderr
+		}
+	} else if isFlagPassed("output") {
+		d.OutputPath = resultFile
+	}
+
+	if throughputLog == "-" {
+		d.ThroughputLog = d.Log
+	} else if throughputLog != "" {
+		file, err := os.Create(throughputLog)
+		if err != nil {
+			return fmt.Errorf("Bad Input: could not create -throughput-log: %w", err)
+		}
+		defer file.Close()
+		d.ThroughputLog = file
+	}
+
+	// Ctrl-C (SIGINT) or SIGTERM cancels ctx, which aborts all requests and chunks in flight
+	ctx, stop := signal.NotifyContext(context.Background(), os.Interrupt, syscall.SIGTERM)
+	defer stop()
+	// The deadline covers everything, including the support check, retries and the checksums
+	if deadline > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, deadline)
+		defer cancel()
+	}
+
+	// Only ask before overwriting if the answer can be read from a terminal
+	if !passwordStdin && isTerminal(os.Stdin) {
+		d.ConfirmOverwrite = confirmOverwrite
+	}
+	if headOnly {
+		remote, err := d.Probe(ctx)
+		if err != nil {
+			return downloadFailed(ctx, deadline, err)
+		}
+		return printRemoteInfo(out, d.URL, remote, jsonOutput)
+	}
+	if urlsFile != "" {
+		if err := downloadAll(ctx, d, urlsFile, checksumFile, extract, extractDir, postHook, out, jsonOutput); err != nil {
+			return downloadFailed(ctx, deadline, err)
+		}
+		return nil
+	}
+	result, err := d.Download(ctx)
+	if err != nil {
+		logDownloadError(&d, err)
+		return downloadFailed(ctx, deadline, err)
+	}
+	if !d.DryRun {
+		if err := printResult(out, &d, result, jsonOutput); err != nil {
+			return err
+		}
+	}
+	if checksumFile != "" {
+		if err := appendChecksumFile(checksumFile, d.Hashes, result); err != nil {
+			return fmt.Errorf("Fatal error in writing -checksum-file: %w", err)
+		}
+	}
+	if extract {
+		if err := extractArchive(result.Path, extractDir, out); err != nil {
+			return fmt.Errorf("Fatal error in extracting %s: %w", result.Path, err)
+		}
+	}
+	if postHook != "" {
+		if err := runPostHook(ctx, postHook, d.URL, result, jsonOutput); err != nil {
+			err = fmt.Errorf("Fatal error in -post-hook: %w", err)
+			// The exit status of the hook becomes the program's
+			var hookErr *exec.ExitError
+			if errors.As(err, &hookErr) && hookErr.ExitCode() > 0 {
+				return &exitError{code: hookErr.ExitCode(), err: err}
+			}
+			return err
+		}
+	}
+	return nil
+}
+
+// extractArchive extracts the archive at path into dir, or into the directory of path if dir is empty
+func extractArchive(path string, dir string, out io.Writer) error {
+	if dir == "" {
+		dir = filepath.Dir(path)
+	}
+	extracted, err := downloader.Extract(path, dir)
+	if err != nil {
+		return err
+	}
+	fmt.Fprintln(out, "Extracted", extracted, "entries to", dir)
+	return nil
+}
+
+// runPostHook runs command with sh after the file downloaded from dwLink has been verified and renamed to its path
+// The hook gets the download in environment variables: MSD_OUTPUT is the path of the file, MSD_SIZE its size in bytes,
+// MSD_URL the URL it was downloaded from, and MSD_<ALGORITHM> every checksum, e.g. MSD_SHA256
+// Its output goes to stdout, or to stderr with -json so that stdout only holds the JSON summary
+func runPostHook(ctx context.Context, command string, dwLink string, result *downloader.Result, jsonOutput bool) error {
+	hook := exec.CommandContext(ctx, "sh", "-c", command)
+	hook.Env = append(os.Environ(),
+		"MSD_OUTPUT="+result.Path,
+		"MSD_SIZE="+strconv.FormatInt(result.Bytes, 10),
+		"MSD_URL="+dwLink,
+	)
+	for algorithm, checksum := range result.Checksums {
+		hook.Env = append(hook.Env, fmt.Sprintf("MSD_%s=%x", strings.ToUpper(algorithm), checksum))
+	}
+	hook.Stdout = os.Stdout
+	if jsonOutput {
+		hook.Stdout = os.Stderr
+	}
+	hook.Stderr = os.Stderr
+	return hook.Run()
+}
+
+// The exit statuses of a failed download, so that scripts can tell why it failed, any other error exits with 1
+const (
+	// exitChecksum is the exit status when the file does not match the expected checksum
+	exitChecksum = 2
+	// exitNetwork is the exit status when the server could not be reached or answered with an error
+	exitNetwork = 3
+	// exitNoRanges is the exit status when a range of the file is requested from a server without HTTP Range requests
+	exitNoRanges = 4
+	// exitCanceled is the exit status when the download is interrupted, or a request timed out
+	exitCanceled = 5
+	// exitDeadline is the exit status when -deadline is exceeded, the same as the timeout command's
+	// It is kept apart from exitCanceled, as -deadline exited with 124 before the other statuses were added,
+	// and scripts wrapping the program like timeout(1) already check for it
+	exitDeadline = 124
+)
 
-	// Check hosting server's support for HTTP Range requests, if yes, get fileSize and anticipated chunkSize
-	fileSize, chunkSize, err := confirmSupportAndFileChunkSize(dwLink, defaultNumChunks)
+// downloadFailed returns err of a failed download, so that the program exits with exitDeadline
+// if it failed because ctx exceeded the -deadline, or else the exit status of exitCode
+func downloadFailed(ctx context.Context, deadline time.Duration, err error) error {
+	if errors.Is(ctx.Err(), context.DeadlineExceeded) {
+		return &exitError{code: exitDeadline, err: fmt.Errorf("%w, aborted as the download did not finish within the -deadline of %s", err, deadline)}
+	}
+	var exitErr *exitError
+	if code := exitCode(ctx, err); code != 1 && !errors.As(err, &exitErr) {
+		return &exitError{code: code, err: err}
+	}
+	return err
+}
+
+// exitCode returns the exit status for err of a download with ctx
+// Only a failed connection and an unexpected response of the server are network errors, anything else,
+// e.g. an invalid configuration, a local file that cannot be written or an archive that cannot be extracted, returns 1
+func exitCode(ctx context.Context, err error) int {
+	var inputErr *downloader.InputError
+	var checksumErr *downloader.ChecksumError
+	var timeout interface{ Timeout() bool }
+	var urlErr *url.Error
+	var statusErr *downloader.StatusError
+	switch {
+	case errors.As(err, &inputErr):
+		return 1
+	case errors.As(err, &checksumErr):
+		return exitChecksum
+	// Ctrl-C and SIGTERM cancel ctx, the -timeout of a chunk and the -stall-timeout are timeouts
+	case errors.Is(ctx.Err(), context.Canceled) || (errors.As(err, &timeout) && timeout.Timeout()):
+		return exitCanceled
+	case errors.Is(err, downloader.ErrRangesNotSupported):
+		return exitNoRanges
+	// A ChunksError unwraps to the errors of its chunks
+	case errors.As(err, &urlErr), errors.As(err, &statusErr), errors.Is(err, downloader.ErrUpstreamChanged), errors.Is(err, downloader.ErrSizeMismatch):
+		return exitNetwork
+	}
+	return 1
+}
+
+// appendChecksumFile appends a "<checksum>  <filename>" line for every algorithm to the file at path, as printed
+// by sha256sum and the like, the filename is relative to the directory of path so that it can be checked from there
+func appendChecksumFile(path string, algorithms []string, result *downloader.Result) error {
+	filename, err := filepath.Abs(result.Path)
+	if err != nil {
+		return err
+	}
+	dir, err := filepath.Abs(filepath.Dir(path))
+	if err != nil {
+		return err
+	}
+	if rel, err := filepath.Rel(dir, filename); err == nil {
+		filename = rel
+	}
+	var lines strings.Builder
+	for _, algorithm := range algorithms {
+		fmt.Fprintf(&lines, "%x  %s\n", result.Checksums[algorithm], filepath.ToSlash(filename))
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0666)
 	if err != nil {
-		log.Fatalln("Fatal error in checking support for multi-source downloads: ", err)
+		return err
+	}
+	if _, err := file.WriteString(lines.String()); err != nil {
+		file.Close()
+		return err
 	}
+	return file.Close()
+}
 
-	if !isFlagPassed("output") {
-		resultFile = getDownloadFileName(dwLink)
-		if resultFile == "" {
-			log.Fatalln("Bad Input: No object to download")
+// logDownloadError logs the failed chunks of err and a hint on how to recover from it, if any, err itself is returned
+// to be logged by main
+func logDownloadError(d *downloader.Downloader, err error) {
+	var chunksErr *downloader.ChunksError
+	isChunksErr := errors.As(err, &chunksErr)
+	if isChunksErr {
+		for _, chunkErr := range chunksErr.Failed {
+			slog.Error("Failed to download a chunk", "error", chunkErr)
+		}
+	}
+	if errors.Is(err, downloader.ErrFileExists) {
+		slog.Info("Use -overwrite to replace it")
+	}
+	if errors.Is(err, downloader.ErrNoSpace) {
+		slog.Info("Free up some space, or use -skip-space-check to download anyway")
+	}
+	if d.Resume && (isChunksErr || errors.Is(err, context.Canceled) || errors.Is(err, context.DeadlineExceeded)) {
+		slog.Info("Run again with -continue to resume")
+	}
+}
+
+// printRemoteInfo prints what the server reports about the file at dwLink, as JSON to stdout with -json
+func printRemoteInfo(out io.Writer, dwLink string, remote *downloader.RemoteInfo, jsonOutput bool) error {
+	if jsonOutput {
+		return json.NewEncoder(os.Stdout).Encode(newJSONRemoteInfo(dwLink, remote))
+	}
+	fmt.Fprintln(out, "URL:", remote.FinalURL)
+	if remote.Size <= 0 && !remote.AcceptsRanges {
+		fmt.Fprintln(out, "Size: unknown")
+	} else {
+		fmt.Fprintf(out, "Size: %d bytes (%s)\n", remote.Size, downloader.FormatBytes(remote.Size))
+	}
+	fmt.Fprintln(out, "Range requests supported:", remote.AcceptsRanges)
+	fmt.Fprintln(out, "Filename:", remote.ResolvedFilename)
+	// The headers the server did not send are left out
+	for _, header := range [][2]string{{"Content-Type", remote.ContentType}, {"ETag", remote.ETag}, {"Last-Modified", remote.LastModified}} {
+		if header[1] != "" {
+			fmt.Fprintf(out, "%s: %s\n", header[0], header[1])
+		}
+	}
+	return nil
+}
+
+// printResult prints the size, speed and checksums of a completed download to out, or its JSON summary to stdout
+func printResult(out io.Writer, d *downloader.Downloader, result *downloader.Result, jsonOutput bool) error {
+	if jsonOutput {
+		if err := json.NewEncoder(os.Stdout).Encode(newJSONSummary(d.URL, result)); err != nil {
+			return err
+		}
+	}
+	fmt.Fprintln(out, "Downloaded", downloader.FormatBytes(result.Bytes), "in", formatSpeed(result.Bytes, result.Elapsed))
+	if stats := result.ChunkStats; stats != nil {
+		fmt.Fprintf(out, "Slowest chunk: %d in %s (fastest %s, average %s), chunk %d finished last, %s after the average chunk time\n",
+			stats.Slowest+1, stats.SlowestTime.Round(time.Millisecond), stats.FastestTime.Round(time.Millisecond),
+			stats.AverageTime.Round(time.Millisecond), stats.Last+1, stats.StragglerCost.Round(time.Millisecond))
+	}
+	if d.Merkle {
+		fmt.Fprintf(out, "Merkle root of %d chunks: %x\n", result.MerkleChunks, result.MerkleRoot)
+		if d.ExpectedMerkleRoot != "" {
+			fmt.Fprintln(out, "OK")
 		}
+		return nil
 	}
-	file, err := os.OpenFile(resultFile, os.O_CREATE|os.O_WRONLY, 0666)
+	if d.NoChecksum {
+		fmt.Fprintln(out, "Checksum verification was skipped (-no-checksum)")
+		return nil
+	}
+	algorithms := make([]string, 0, len(result.Checksums))
+	for algorithm := range result.Checksums {
+		algorithms = append(algorithms, algorithm)
+	}
+	sort.Strings(algorithms)
+	// The checksums of a range are not those of the file, so they are labeled with the range
+	label := "Checksum"
+	if d.RangeStart > 0 || d.RangeLength > 0 {
+		label = fmt.Sprintf("Checksum of bytes %d-%d", d.RangeStart, d.RangeStart+result.Bytes-1)
+	}
+	for _, algorithm := range algorithms {
+		fmt.Fprintf(out, "%s %s: %x\n", strings.ToUpper(algorithm), label, result.Checksums[algorithm])
+	}
+	if len(d.Expected) > 0 || d.VerifySidecar {
+		fmt.Fprintln(out, "OK")
+	}
+	return nil
+}
+
+// formatSpeed returns the elapsed time with the average speed, e.g. "14s (88.0 MB/s)"
+func formatSpeed(bytes int64, elapsed time.Duration) string {
+	precision := time.Microsecond
+	if elapsed > time.Second {
+		precision = time.Millisecond
+	}
+	speed := fmt.Sprint(elapsed.Round(precision))
+	if seconds := elapsed.Seconds(); seconds > 0 {
+		speed += fmt.Sprint(" (", downloader.FormatBytes(int64(float64(bytes)/seconds)), "/s)")
+	}
+	return speed
+}
+
+// readURLs returns the URLs in the file at path, one per line, skipping blank lines and # comments
+func readURLs(path string) ([]string, error) {
+	file, err := os.Open(path)
 	if err != nil {
-		log.Fatalln(err)
+		return nil, err
+	}
+	defer file.Close()
+	var urls []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		urls = append(urls, line)
 	}
+	return urls, scanner.Err()
+}
 
-	var rangeStart, rangeEnd int64
-	var downloaderWg sync.WaitGroup
+// downloadAll downloads every URL in urlsFile one after the other with the options of d,
+// and prints the result of each and a summary with the failed URLs at the end, the checksums are appended to checksumFile,
+// every archive is extracted into extractDir if extract is set, and postHook is run for every downloaded file if set
+// It returns an error if any download failed, with the exit status of the first failed download
+func downloadAll(ctx context.Context, d downloader.Downloader, urlsFile string, checksumFile string, extract bool, extractDir string, postHook string, out io.Writer, jsonOutput bool) error {
+	urls, err := readURLs(urlsFile)
+	if err != nil {
+		return fmt.Errorf("Bad Input: could not read -urls-file: %w", err)
+	}
+	// A typo in any URL stops the run before the first download
+	for _, link := range urls {
+		if _, ok := localFileURL(link); ok {
+			continue
+		}
+		if err := checkURL(link); err != nil {
+			return fmt.Errorf("Bad Input: -urls-file %w", err)
+		}
+	}
 	startTime := time.Now()
-	fmt.Println("Downloading ", resultFile, " in ", defaultNumChunks, " chunks...")
-	for i := uint(0); i < defaultNumChunks; i++ {
-		if i == defaultNumChunks-1 {
-			// For the last chunk, ensure rangeEnd is up to fileSize
-			rangeEnd = fileSize 
-		} else {
-			// rangeStart is 0 indexed, so rangeEnd is adjusted
-			rangeEnd = rangeStart + chunkSize - 1 
-		}
-		downloaderWg.Add(1)
-		go func(i uint, dwLink string, rangeStart int64, rangeEnd int64, file *os.File, downloaderWg *sync.WaitGroup) {
-			response, err := getObjectRange(dwLink, rangeStart, rangeEnd)
-			if err != nil {
-				log.Fatalf("Request error in chunk: %d, Error: %s\n", i, err.Error())
+	var totalBytes int64
+	var failed []string
+	// firstErr is the error of the first failed download, which the exit status is derived from
+	var firstErr error
+	for i, link := range urls {
+		if ctx.Err() != nil {
+			failed = append(failed, link)
+			continue
+		}
+		fileDownloader := d
+		fileDownloader.URL = link
+		if fileURL, ok := localFileURL(link); ok {
+			fileDownloader.URL = fileURL
+		}
+		fmt.Fprintf(out, "[%d/%d] %s\n", i+1, len(urls), link)
+		result, err := fileDownloader.Download(ctx)
+		if err != nil {
+			logDownloadError(&fileDownloader, err)
+			slog.Error(err.Error(), "url", link)
+			failed = append(failed, link)
+			if firstErr == nil {
+				firstErr = err
 			}
-			writeChunks(response, file, i, rangeStart, downloaderWg)
-		}(i, dwLink, rangeStart, rangeEnd, file, &downloaderWg)
-		rangeStart =  rangeEnd + 1
+			continue
+		}
+		totalBytes += result.Bytes
+		if !d.DryRun {
+			if err := printResult(out, &fileDownloader, result, jsonOutput); err != nil {
+				return err
+			}
+		}
+		if checksumFile != "" {
+			if err := appendChecksumFile(checksumFile, d.Hashes, result); err != nil {
+				slog.Error("Fatal error in writing -checksum-file", "error", err, "url", link)
+				failed = append(failed, link)
+				continue
+			}
+		}
+		if extract {
+			if err := extractArchive(result.Path, extractDir, out); err != nil {
+				slog.Error("Fatal error in extracting "+result.Path, "error", err, "url", link)
+				failed = append(failed, link)
+				continue
+			}
+		}
+		if postHook != "" {
+			if err := runPostHook(ctx, postHook, fileDownloader.URL, result, jsonOutput); err != nil {
+				slog.Error("Fatal error in -post-hook", "error", err, "url", link)
+				failed = append(failed, link)
+			}
+		}
 	}
-	downloaderWg.Wait()
-	elapsed := time.Since(startTime)
-	fmt.Println("Time to download was: ", elapsed)
-	file.Close()
-	writtenFile, err := os.OpenFile(resultFile, os.O_RDONLY, 0666)
-	h := sha256.New()
-	if _, err := io.Copy(h, writtenFile); err != nil {
-		log.Fatal("Error while calculating SHA256 checksum: ", err)
+	fmt.Fprintln(out, "Downloaded", len(urls)-len(failed), "of", len(urls), "files,", downloader.FormatBytes(totalBytes), "in", formatSpeed(totalBytes, time.Since(startTime)))
+	for _, link := range failed {
+		slog.Error("Failed to download", "url", link)
 	}
-	fmt.Printf("SHA256 Checksum: %x\n", h.Sum(nil))
-
+	if len(failed) > 0 {
+		err := fmt.Errorf("%d of %d downloads failed", len(failed), len(urls))
+		if firstErr != nil {
+			if code := exitCode(ctx, firstErr); code != 1 {
+				return &exitError{code: code, err: err}
+			}
+		}
+		return err
+	}
+	return nil
 }
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/url"
+	"os"
+	"testing"
+
+	"github.com/reethikar/multi-source-downloader/downloader"
+)
+
+func TestParseSize(t *testing.T) {
+	tests := []struct {
+		value string
+		want  int64
+		// err is whether value is rejected
+		err bool
+	}{
+		{value: "0", want: 0},
+		{value: "512", want: 512},
+		{value: "512B", want: 512},
+		// The single letter suffixes are binary, the ones ending with B decimal
+		{value: "64k", want: 64 << 10},
+		{value: "64K", want: 64 << 10},
+		{value: "64KiB", want: 64 << 10},
+		{value: "64kB", want: 64000},
+		{value: "64KB", want: 64000},
+		{value: "10M", want: 10 << 20},
+		{value: "10m", want: 10 << 20},
+		{value: "10MiB", want: 10 << 20},
+		{value: "10MB", want: 10e6},
+		{value: "2G", want: 2 << 30},
+		{value: "2GiB", want: 2 << 30},
+		{value: "2GB", want: 2e9},
+		{value: "3T", want: 3 << 40},
+		{value: "3TB", want: 3e12},
+		// Fractions are rounded down to whole bytes
+		{value: "1.5G", want: 3 << 29},
+		{value: "0.5k", want: 512},
+		{value: "1.5", want: 1},
+		{value: "1.0001k", want: 1024},
+		{value: "", err: true},
+		{value: "k", err: true},
+		{value: "abc", err: true},
+		{value: "-1", err: true},
+		{value: "-1M", err: true},
+		{value: "NaN", err: true},
+		{value: "10 M", err: true},
+		{value: "10X", err: true},
+		{value: "1..5M", err: true},
+		// Sizes that do not fit into an int64
+		{value: "9223372036854775807", err: true},
+		{value: "8388608T", err: true},
+		{value: "Inf", err: true},
+	}
+	for _, test := range tests {
+		got, err := parseSize(test.value)
+		if test.err {
+			if err == nil {
+				t.Errorf("parseSize(%q) = %d, want an error", test.value, got)
+			}
+			continue
+		}
+		if err != nil || got != test.want {
+			t.Errorf("parseSize(%q) = %d, %v, want %d", test.value, got, err, test.want)
+		}
+	}
+}
+
+func TestExitCode(t *testing.T) {
+	connErr := &url.Error{Op: "Get", URL: "http://example.com/f", Err: errors.New("connection refused")}
+	notFound := &downloader.StatusError{StatusCode: 404, Status: "404 Not Found"}
+	tests := []struct {
+		name string
+		err  error
+		want int
+	}{
+		{"invalid configuration", &downloader.InputError{Err: errors.New("Bad Input: no URL to download")}, 1},
+		{"checksum mismatch", fmt.Errorf("Fatal error in verifying the checksum: %w", &downloader.ChecksumError{Algorithm: "sha256"}), exitChecksum},
+		{"connection refused", fmt.Errorf("HTTP error: HEAD request failed: %w", connErr), exitNetwork},
+		{"HTTP status", fmt.Errorf("Fatal error in single stream download: %w", notFound), exitNetwork},
+		{"failed chunks", &downloader.ChunksError{Failed: []*downloader.ChunkError{{Chunk: 1, Err: notFound}}, Chunks: 4}, exitNetwork},
+		{"upstream changed", &downloader.ChunksError{Failed: []*downloader.ChunkError{{Err: downloader.ErrUpstreamChanged}}, Chunks: 2}, exitNetwork},
+		{"no range support", fmt.Errorf("Fatal error: %w", downloader.ErrRangesNotSupported), exitNoRanges},
+		{"chunk timeout", &downloader.ChunksError{Failed: []*downloader.ChunkError{{Err: context.DeadlineExceeded}}, Chunks: 2}, exitCanceled},
+		{"local file", fmt.Errorf("Fatal error in creating file: %w", &os.PathError{Op: "open", Path: "/x", Err: os.ErrPermission}), 1},
+		{"archive", errors.New("Fatal error in extracting file.tar: unsupported entry"), 1},
+		{"manifest", errors.New("invalid manifest: unknown version 3"), 1},
+	}
+	for _, test := range tests {
+		if got := exitCode(context.Background(), test.err); got != test.want {
+			t.Errorf("%s: exitCode(%v) = %d, want %d", test.name, test.err, got, test.want)
+		}
+	}
+	canceled, cancel := context.WithCancel(context.Background())
+	cancel()
+	if got := exitCode(canceled, fmt.Errorf("HTTP error: %w", context.Canceled)); got != exitCanceled {
+		t.Errorf("exitCode of a canceled download = %d, want %d", got, exitCanceled)
+	}
+}